@@ -0,0 +1,71 @@
+package main
+
+import (
+	"encoding/csv"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/Clever/signalfx-janitor/janitor"
+)
+
+// auditHeader is the first row of a new audit file
+var auditHeader = []string{"timestamp", "incident_id", "detector_name", "detector_id", "age_seconds"}
+
+// auditLog appends a CSV row per resolved incident, flushing each row so a
+// crash can't lose records
+type auditLog struct {
+	mu   sync.Mutex
+	file *os.File
+	w    *csv.Writer
+}
+
+// openAuditLog opens path for appending, writing the header if it's new
+func openAuditLog(path string) (*auditLog, error) {
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+	a := &auditLog{file: file, w: csv.NewWriter(file)}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	if info.Size() == 0 {
+		if err := a.write(auditHeader); err != nil {
+			file.Close()
+			return nil, err
+		}
+	}
+	return a, nil
+}
+
+// Record logs that i was resolved at now
+func (a *auditLog) Record(i janitor.SimpleIncident, now time.Time) error {
+	return a.write([]string{
+		now.Format(time.RFC3339),
+		i.ID,
+		i.DetectorName,
+		i.DetectorID,
+		strconv.FormatInt(int64(now.Sub(i.UpdatedAt).Seconds()), 10),
+	})
+}
+
+func (a *auditLog) write(row []string) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.w.Write(row)
+	a.w.Flush()
+	if err := a.w.Error(); err != nil {
+		return err
+	}
+	return a.file.Sync()
+}
+
+// Close closes the audit file
+func (a *auditLog) Close() error {
+	return a.file.Close()
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Clever/signalfx-janitor/janitor"
+)
+
+// configFilePath finds the value of the config flag in args. It has to be
+// read before configure parses the flags, so that flags can override the file.
+func configFilePath(args []string) string {
+	for n, arg := range args {
+		name := strings.TrimLeft(arg, "-")
+		if name == arg {
+			continue
+		}
+		if name == "config" && n+1 < len(args) {
+			return args[n+1]
+		}
+		if strings.HasPrefix(name, "config=") {
+			return strings.TrimPrefix(name, "config=")
+		}
+	}
+	return ""
+}
+
+// applyConfigFile sets fields of the config struct pointed to by config from
+// a JSON object in path, keyed by the fields' config tags (the flag names).
+// Values may be strings, or numbers and bools where the flag expects one.
+func applyConfigFile(path string, config interface{}) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	values := map[string]interface{}{}
+	if err := json.Unmarshal(data, &values); err != nil {
+		return fmt.Errorf("error parsing %s: %w", path, err)
+	}
+
+	v := reflect.ValueOf(config).Elem()
+	fields := map[string]reflect.Value{}
+	for i := 0; i < v.NumField(); i++ {
+		name := strings.Split(v.Type().Field(i).Tag.Get("config"), ",")[0]
+		fields[name] = v.Field(i)
+	}
+
+	for key, value := range values {
+		field, ok := fields[key]
+		if !ok || key == "config" {
+			return fmt.Errorf("%s: unknown setting %q", path, key)
+		}
+		switch value := value.(type) {
+		case string:
+			if field.Kind() != reflect.String {
+				return fmt.Errorf("%s: %s must be a bool", path, key)
+			}
+			field.SetString(value)
+		case float64:
+			if field.Kind() != reflect.String {
+				return fmt.Errorf("%s: %s must be a bool", path, key)
+			}
+			field.SetString(strconv.FormatFloat(value, 'f', -1, 64))
+		case bool:
+			if field.Kind() != reflect.Bool {
+				return fmt.Errorf("%s: %s must be a string", path, key)
+			}
+			field.SetBool(value)
+		default:
+			return fmt.Errorf("%s: unsupported value for %s", path, key)
+		}
+	}
+	return nil
+}
+
+// loadRules reads per-detector stale-after rules from a JSON list in file, e.g.
+//
+//	[{"detector": "batch-*", "staleAfter": "6h"}]
+func loadRules(file string) ([]janitor.StaleRule, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	raw := []struct {
+		Detector   string `json:"detector"`
+		StaleAfter string `json:"staleAfter"`
+	}{}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, fmt.Errorf("error parsing %s: %w", file, err)
+	}
+
+	rules := []janitor.StaleRule{}
+	for n, r := range raw {
+		if r.Detector == "" {
+			return nil, fmt.Errorf("%s: rule %d: invalid detector pattern %q", file, n, r.Detector)
+		}
+		staleAfter, err := time.ParseDuration(r.StaleAfter)
+		if err != nil || staleAfter <= 0 {
+			return nil, fmt.Errorf("%s: rule %d: staleAfter must be a positive duration, got %q", file, n, r.StaleAfter)
+		}
+		rules = append(rules, janitor.StaleRule{Detector: r.Detector, StaleAfter: staleAfter})
+	}
+	return rules, nil
+}
+
+// envOverride sets *value from the env var name, if it's set
+func envOverride(value *string, name string) {
+	if env := os.Getenv(name); env != "" {
+		*value = env
+	}
+}
+
+// sensitiveSettings are never logged
+var sensitiveSettings = map[string]bool{
+	"token":         true,
+	"password":      true,
+	"slack-webhook": true,
+	"error-webhook": true,
+}
+
+// restartSettings configure the client, servers, or loop, which are set up
+// once, so reloading them has no effect until the janitor restarts
+var restartSettings = map[string]bool{
+	"token": true, "token-file": true, "org-id": true, "allowed-orgs": true,
+	"realm": true, "api-url": true, "ca-cert": true, "user-agent": true,
+	"auth-mode": true, "email": true, "password": true, "skip-auth-check": true,
+	"http-timeout": true, "max-retries": true, "retry-on-parse-error": true, "requests-per-second": true,
+	"max-mute-duration": true, "allow-long-mute": true, "log-level": true, "timezone": true,
+	"metrics-addr": true, "health-addr": true, "interval": true, "startup-jitter": true, "config": true,
+}
+
+// logChangedSettings logs the settings that differ between the config
+// structs old and new, keyed by their config tags
+func logChangedSettings(logger janitor.Logger, old, new interface{}) {
+	o, n := reflect.ValueOf(old), reflect.ValueOf(new)
+	changed := false
+	for i := 0; i < o.NumField(); i++ {
+		name := strings.Split(o.Type().Field(i).Tag.Get("config"), ",")[0]
+		before, after := fmt.Sprint(o.Field(i).Interface()), fmt.Sprint(n.Field(i).Interface())
+		if before == after {
+			continue
+		}
+		changed = true
+		if sensitiveSettings[name] {
+			logger.Infof("reloaded %s", name)
+		} else {
+			logger.Infof("reloaded %s: %q -> %q", name, before, after)
+		}
+		if restartSettings[name] {
+			logger.Warnf("%s only takes effect after a restart", name)
+		}
+	}
+	if !changed {
+		logger.Infof("reloaded settings, nothing changed")
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/Clever/signalfx-janitor/janitor"
+)
+
+// healthPingTimeout bounds the API check done by each health probe
+const healthPingTimeout = 5 * time.Second
+
+// health answers liveness probes: healthy while runs keep completing within
+// maxAge of each other and the API is reachable
+type health struct {
+	client *janitor.SFXClient
+	maxAge time.Duration
+
+	mu      sync.Mutex
+	started time.Time
+	lastRun time.Time
+}
+
+func newHealth(client *janitor.SFXClient, maxAge time.Duration) *health {
+	return &health{client: client, maxAge: maxAge, started: time.Now()}
+}
+
+// observeRun records that a run completed, successfully or not
+func (h *health) observeRun(at time.Time) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.lastRun = at
+}
+
+// check returns why the janitor is unhealthy, or nil. Until the first run
+// completes, the time the janitor started stands in for it.
+func (h *health) check(ctx context.Context) error {
+	h.mu.Lock()
+	last := h.lastRun
+	if last.IsZero() {
+		last = h.started
+	}
+	h.mu.Unlock()
+
+	if age := time.Since(last); age > h.maxAge {
+		return fmt.Errorf("no run completed in %s", age.Round(time.Second))
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, healthPingTimeout)
+	defer cancel()
+	if err := h.client.Ping(ctx); err != nil {
+		return fmt.Errorf("API check failed: %w", err)
+	}
+	return nil
+}
+
+func (h *health) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain")
+	if err := h.check(r.Context()); err != nil {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprintln(w, err)
+		return
+	}
+	fmt.Fprintln(w, "ok")
+}
+
+// serveHealth exposes h on addr at /healthz, in the background
+func serveHealth(addr string, h *health, logger janitor.Logger) {
+	mux := http.NewServeMux()
+	mux.Handle("/healthz", h)
+	go func() {
+		if err := http.ListenAndServe(addr, mux); err != nil {
+			logger.Errorf("health server stopped: %s", err)
+		}
+	}()
+}
@@ -0,0 +1,108 @@
+package janitor
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+)
+
+// cachedResponse is a response body kept for conditional requests, with the
+// URL it came from and the validators the server sent along with it
+type cachedResponse struct {
+	url          string
+	etag         string
+	lastModified string
+	body         []byte
+}
+
+// cacheKey is the endpoint and page req is for. Only the latest response for
+// each is kept, so URLs that change from run to run (e.g. a query with a
+// since timestamp) replace each other instead of piling up.
+func cacheKey(req *http.Request) string {
+	q := req.URL.Query()
+	return req.URL.Path + "?offset=" + q.Get("offset") + "&limit=" + q.Get("limit")
+}
+
+// getConditional sends the GET req, revalidating the body the server last
+// sent for the same URL if it came with an ETag or Last-Modified header. On
+// a 304 the cached body is returned instead. Servers that don't support
+// conditional requests just never get them. Errors are retried as by
+// doWithRetry. resp's body is already closed.
+func (c *SFXClient) getConditional(req *http.Request) (*http.Response, []byte, error) {
+	key := cacheKey(req)
+	c.cacheMu.Lock()
+	cached, ok := c.cache[key]
+	c.cacheMu.Unlock()
+	ok = ok && cached.url == req.URL.String()
+	if ok {
+		if cached.etag != "" {
+			req.Header.Set("If-None-Match", cached.etag)
+		}
+		if cached.lastModified != "" {
+			req.Header.Set("If-Modified-Since", cached.lastModified)
+		}
+	} else {
+		// a parse retry reuses req after dropping the entry it revalidated
+		req.Header.Del("If-None-Match")
+		req.Header.Del("If-Modified-Since")
+	}
+
+	resp, err := c.doWithRetry(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotModified && ok {
+		c.logger.Debugf("%s %s not modified, reusing the last response", req.Method, req.URL.Path)
+		return resp, cached.body, nil
+	}
+	if resp.StatusCode != 200 {
+		return resp, nil, newAPIError(resp)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return resp, nil, err
+	}
+
+	etag, lastModified := resp.Header.Get("ETag"), resp.Header.Get("Last-Modified")
+	c.cacheMu.Lock()
+	if etag != "" || lastModified != "" {
+		c.cache[key] = cachedResponse{url: req.URL.String(), etag: etag, lastModified: lastModified, body: body}
+	} else {
+		delete(c.cache, key)
+	}
+	c.cacheMu.Unlock()
+	return resp, body, nil
+}
+
+// getConditionalJSON is getConditional, decoding the body into v. A body that
+// can't be decoded, e.g. an HTML error page a proxy sent with a 200, is
+// retried with backoff up to the client's parseRetries times.
+func (c *SFXClient) getConditionalJSON(req *http.Request, v interface{}) error {
+	for attempt := 0; ; attempt++ {
+		resp, body, err := c.getConditional(req)
+		if err != nil {
+			return err
+		}
+		err = json.Unmarshal(body, v)
+		if err == nil {
+			return nil
+		}
+
+		// don't revalidate the garbage on the next attempt
+		c.cacheMu.Lock()
+		delete(c.cache, cacheKey(req))
+		c.cacheMu.Unlock()
+
+		err = newDecodeError(resp, body, err)
+		if attempt >= c.parseRetries || req.Context().Err() != nil {
+			return err
+		}
+		delay := retryDelay(attempt, nil)
+		c.logger.Warnf("retrying %s %s in %s after %s", req.Method, req.URL.Path, delay, err)
+		if err := sleep(req.Context(), delay); err != nil {
+			return err
+		}
+	}
+}
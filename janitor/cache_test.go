@@ -0,0 +1,107 @@
+package janitor
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestCacheKeepsLatestPerPage(t *testing.T) {
+	requests, revalidated := 0, 0
+	client, server := newTestClient(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			revalidated++
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", `"v1"`)
+		w.Write([]byte(`{"rs": [{"sf_incidentId": "i1", "sf_updatedOnMs": 1000}]}`))
+	})
+	defer server.Close()
+
+	list := func(opts ListOptions) {
+		t.Helper()
+		opts.PageSize, opts.Query = 10, DefaultIncidentQuery
+		incidents, err := GetV1Incidents(context.Background(), client, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkIDs(t, incidents, "i1")
+	}
+
+	// each since makes a different query
+	list(ListOptions{Since: time.Hour})
+	time.Sleep(2 * time.Millisecond)
+	list(ListOptions{Since: time.Hour})
+	if len(client.cache) != 1 {
+		t.Errorf("cache has %d entries, want 1", len(client.cache))
+	}
+	if revalidated != 0 {
+		t.Errorf("revalidated %d times with another query's ETag", revalidated)
+	}
+
+	list(ListOptions{})
+	list(ListOptions{})
+	if revalidated != 1 {
+		t.Errorf("revalidated %d times, want 1", revalidated)
+	}
+	if requests != 4 {
+		t.Errorf("requests = %d, want 4", requests)
+	}
+}
+
+func TestCacheHitThenParseRetry(t *testing.T) {
+	requests := 0
+	client, server := newTestClient(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		switch {
+		case r.Header.Get("If-None-Match") != "" && requests == 2:
+			w.Write([]byte("<html>bad gateway</html>"))
+		case r.Header.Get("If-None-Match") != "":
+			w.WriteHeader(http.StatusNotModified)
+		default:
+			w.Header().Set("ETag", `"v1"`)
+			w.Write([]byte(`{"rs": [{"sf_incidentId": "i1", "sf_updatedOnMs": 1000}]}`))
+		}
+	}, func(cfg *SFXClientConfig) {
+		cfg.ParseRetries = 1
+	})
+	defer server.Close()
+
+	for n := 0; n < 2; n++ {
+		incidents, err := GetV1Incidents(context.Background(), client, ListOptions{PageSize: 10, Query: DefaultIncidentQuery})
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkIDs(t, incidents, "i1")
+	}
+	if requests != 3 {
+		t.Errorf("requests = %d, want 3", requests)
+	}
+}
+
+func TestListingRetriesServerErrors(t *testing.T) {
+	requests := 0
+	client, server := newTestClient(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if requests == 1 {
+			http.Error(w, "bad gateway", http.StatusBadGateway)
+			return
+		}
+		w.Write([]byte(`{"rs": [{"sf_incidentId": "i1", "sf_updatedOnMs": 1000}]}`))
+	}, func(cfg *SFXClientConfig) {
+		cfg.MaxRetries = 3
+	})
+	defer server.Close()
+
+	incidents, err := GetV1Incidents(context.Background(), client, ListOptions{PageSize: 10, Query: DefaultIncidentQuery})
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkIDs(t, incidents, "i1")
+	if requests != 2 {
+		t.Errorf("requests = %d, want 2", requests)
+	}
+}
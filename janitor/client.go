@@ -0,0 +1,545 @@
+// Package janitor cleans up stale SignalFX incidents and manages alert
+// mutings. It backs the signalfx-janitor command, and can be embedded in
+// other tooling.
+package janitor
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"math/rand"
+	"net/http"
+	"os"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultBaseURL is the API endpoint for the legacy us0 realm
+const DefaultBaseURL = "https://api.signalfx.com/"
+
+// APIBaseURL picks the SignalFX API endpoint. A full apiURL override (for
+// on-prem or proxy setups) wins over realm, and an empty realm falls back to
+// the legacy endpoint.
+func APIBaseURL(realm, apiURL string) string {
+	if apiURL != "" {
+		if !strings.HasSuffix(apiURL, "/") {
+			apiURL += "/"
+		}
+		return apiURL
+	}
+	if realm == "" {
+		return DefaultBaseURL
+	}
+	return fmt.Sprintf("https://api.%s.signalfx.com/", realm)
+}
+
+// SFXClient makes authenticated requests against a single SignalFX org
+type SFXClient struct {
+	token        string
+	authMode     string
+	email        string
+	password     string
+	orgID        string
+	baseURL      string
+	httpClient   *http.Client
+	maxRetries   int
+	parseRetries int
+	limiter      *rateLimiter
+	logger       Logger
+	onAPIError   func(statusCode int)
+	userAgent    string
+	tracer       Tracer
+
+	fallbackTokens []string
+
+	cacheMu sync.Mutex
+	cache   map[string]cachedResponse // by endpoint and page, see cacheKey
+
+	rateLimitThreshold int
+	pauseMu            sync.Mutex
+	pauseUntil         time.Time
+
+	orgMu sync.Mutex
+	org   *Organization
+}
+
+// SFXClientConfig configures an SFXClient
+type SFXClientConfig struct {
+	// BaseURL is the API endpoint, see APIBaseURL. Defaults to DefaultBaseURL.
+	BaseURL string
+	Token   string
+	OrgID   string
+	// AuthMode is AuthModeOrg (the default), which uses Token, or
+	// AuthModeSession, which uses Email and Password instead.
+	AuthMode string
+	Email    string
+	Password string
+	// Timeout bounds each request, including reading the response body.
+	// Defaults to DefaultHTTPTimeout.
+	Timeout time.Duration
+	// RootCAs, if set, replaces the system CAs for verifying the API's
+	// certificate, e.g. to trust a corporate proxy's CA.
+	// HTTP_PROXY/HTTPS_PROXY are honored either way.
+	RootCAs *x509.CertPool
+	// MaxRetries is how many times a transient failure is retried
+	MaxRetries int
+	// ParseRetries is how many times an incident listing is retried when
+	// it gets a 200 whose body isn't the expected JSON
+	ParseRetries int
+	// RequestsPerSecond caps the rate of outgoing requests. Zero means unlimited.
+	RequestsPerSecond float64
+	// Logger receives everything the client and the functions using it log.
+	// Defaults to info level on stderr.
+	Logger Logger
+	// OnAPIError, if set, is called for every request that fails with a 4xx
+	// or 5xx (including ones that are retried), or with statusCode 0 for
+	// requests that got no response, e.g. to count errors in metrics.
+	OnAPIError func(statusCode int)
+	// RateLimitThreshold is how low X-RateLimit-Remaining may drop before
+	// the client waits for X-RateLimit-Reset. Defaults to
+	// DefaultRateLimitThreshold; negative disables proactive backoff.
+	RateLimitThreshold int
+	// UserAgent is sent with every request. Defaults to DefaultUserAgent().
+	UserAgent string
+	// FallbackTokens are tried in order, in AuthModeOrg, when a request
+	// made with Token is forbidden, for orgs whose tokens are scoped to
+	// teams and can't all see every incident or detector.
+	FallbackTokens []string
+	// Tracer, if set, gets a span around each incident listing, incident
+	// clear and detector mute. Nil disables tracing.
+	Tracer Tracer
+}
+
+// DefaultRateLimitThreshold leaves some headroom under the API's rate limit
+// for other clients sharing the token
+const DefaultRateLimitThreshold = 10
+
+// DefaultHTTPTimeout keeps a stalled API from hanging a janitor run forever
+const DefaultHTTPTimeout = 30 * time.Second
+
+// modulePath is this module's import path, for finding its build version
+const modulePath = "github.com/Clever/signalfx-janitor"
+
+// DefaultUserAgent is "signalfx-janitor/<version>", so API logs can
+// attribute traffic to the janitor. The version comes from the build info,
+// and is "dev" for builds from a checkout.
+func DefaultUserAgent() string {
+	version := "dev"
+	if info, ok := debug.ReadBuildInfo(); ok {
+		modules := append([]*debug.Module{&info.Main}, info.Deps...)
+		for _, m := range modules {
+			if m.Path == modulePath && m.Version != "" && m.Version != "(devel)" {
+				version = m.Version
+			}
+		}
+	}
+	return "signalfx-janitor/" + version
+}
+
+// NewSFXClient returns a client for the org and endpoint in cfg
+func NewSFXClient(cfg SFXClientConfig) *SFXClient {
+	if cfg.BaseURL == "" {
+		cfg.BaseURL = DefaultBaseURL
+	}
+	if cfg.AuthMode == "" {
+		cfg.AuthMode = AuthModeOrg
+	}
+	if cfg.RateLimitThreshold == 0 {
+		cfg.RateLimitThreshold = DefaultRateLimitThreshold
+	}
+	if cfg.Timeout == 0 {
+		cfg.Timeout = DefaultHTTPTimeout
+	}
+	if cfg.Logger == nil {
+		cfg.Logger = NewLogger(os.Stderr, LevelInfo)
+	}
+	if cfg.UserAgent == "" {
+		cfg.UserAgent = DefaultUserAgent()
+	}
+	return &SFXClient{
+		token:        cfg.Token,
+		authMode:     cfg.AuthMode,
+		email:        cfg.Email,
+		password:     cfg.Password,
+		orgID:        cfg.OrgID,
+		baseURL:      cfg.BaseURL,
+		httpClient:   &http.Client{Timeout: cfg.Timeout, Transport: newTransport(cfg.RootCAs)},
+		maxRetries:   cfg.MaxRetries,
+		parseRetries: cfg.ParseRetries,
+		limiter:      newRateLimiter(cfg.RequestsPerSecond),
+		logger:       cfg.Logger,
+		onAPIError:   cfg.OnAPIError,
+		userAgent:    cfg.UserAgent,
+		tracer:       cfg.Tracer,
+
+		fallbackTokens: cfg.FallbackTokens,
+		cache:          map[string]cachedResponse{},
+
+		rateLimitThreshold: cfg.RateLimitThreshold,
+	}
+}
+
+// newTransport is http.DefaultTransport (so proxy env vars still apply),
+// trusting rootCAs if set
+func newTransport(rootCAs *x509.CertPool) http.RoundTripper {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if rootCAs != nil {
+		transport.TLSClientConfig = &tls.Config{RootCAs: rootCAs}
+	}
+	return transport
+}
+
+// newRequest builds an authenticated request for path, relative to the base
+// URL. Cancelling ctx aborts the request, including any rate limit or retry waits.
+func (c *SFXClient) newRequest(ctx context.Context, method, path string, body io.Reader) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, method, c.baseURL+path, body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", c.userAgent)
+	c.setAuth(req)
+	return req, nil
+}
+
+// setAuth adds the client's credentials to req. Org and session tokens both
+// go in X-SF-TOKEN; before Authenticate has run in AuthModeSession there is
+// no token to send.
+func (c *SFXClient) setAuth(req *http.Request) {
+	if c.token != "" {
+		req.Header.Set("X-SF-TOKEN", c.token)
+	}
+}
+
+// do sends req, retrying it with each fallback token in turn while it's
+// forbidden. Which token succeeded is logged, never the token itself.
+func (c *SFXClient) do(req *http.Request) (*http.Response, error) {
+	resp, err := c.send(req)
+	for n := 0; n < len(c.fallbackTokens) && err == nil && resp.StatusCode == http.StatusForbidden; n++ {
+		if req.Body != nil && req.GetBody == nil {
+			break
+		}
+		resp.Body.Close()
+		if req.GetBody != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			req.Body = body
+		}
+		req.Header.Set("X-SF-TOKEN", c.fallbackTokens[n])
+		resp, err = c.send(req)
+		if err == nil && resp.StatusCode != http.StatusForbidden {
+			c.logger.Debugf("%s %s succeeded with fallback token %d", req.Method, req.URL.Path, n+1)
+		}
+	}
+	// later retries of req start over from the primary token
+	c.setAuth(req)
+	return resp, err
+}
+
+// send sends req once, within the client's rate limits
+func (c *SFXClient) send(req *http.Request) (*http.Response, error) {
+	if err := c.limiter.Wait(req.Context()); err != nil {
+		return nil, err
+	}
+	if err := c.waitForRateLimitReset(req.Context()); err != nil {
+		return nil, err
+	}
+	resp, err := c.httpClient.Do(req)
+	if err == nil {
+		c.observeRateLimit(resp)
+		spanFromRequest(req).SetAttribute("http.status_code", resp.StatusCode)
+	}
+	if c.onAPIError != nil {
+		if err != nil && req.Context().Err() == nil {
+			c.onAPIError(0)
+		} else if err == nil && resp.StatusCode >= 400 {
+			c.onAPIError(resp.StatusCode)
+		}
+	}
+	return resp, err
+}
+
+// rateLimiter is a token bucket shared by every request a client makes
+type rateLimiter struct {
+	mu     sync.Mutex
+	rate   float64 // tokens added per second
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// newRateLimiter allows requestsPerSecond on average, with bursts of up to
+// one second's worth. A non-positive rate returns nil, which never blocks.
+func newRateLimiter(requestsPerSecond float64) *rateLimiter {
+	if requestsPerSecond <= 0 {
+		return nil
+	}
+	burst := math.Max(1, math.Floor(requestsPerSecond))
+	return &rateLimiter{
+		rate:   requestsPerSecond,
+		burst:  burst,
+		tokens: burst,
+		last:   time.Now(),
+	}
+}
+
+// Wait blocks until a token is available. Callers that find the bucket empty
+// reserve a token anyway (driving the balance negative) and sleep for the
+// deficit, so concurrent waiters are released in order at the limited rate.
+// It returns early with ctx's error if ctx is done first.
+func (l *rateLimiter) Wait(ctx context.Context) error {
+	if l == nil {
+		return nil
+	}
+
+	l.mu.Lock()
+	now := time.Now()
+	l.tokens = math.Min(l.burst, l.tokens+now.Sub(l.last).Seconds()*l.rate)
+	l.last = now
+	l.tokens--
+	deficit := -l.tokens
+	l.mu.Unlock()
+
+	if deficit > 0 {
+		return sleep(ctx, time.Duration(deficit/l.rate*float64(time.Second)))
+	}
+	return nil
+}
+
+// sleep waits for d, or until ctx is done
+func sleep(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// observeRateLimit reads SignalFX's rate limit headers, and when the
+// remaining requests drop to the threshold, pauses the client until the
+// limit resets
+func (c *SFXClient) observeRateLimit(resp *http.Response) {
+	remaining, err := strconv.Atoi(resp.Header.Get("X-RateLimit-Remaining"))
+	if err != nil {
+		return
+	}
+	c.logger.Debugf("rate limit remaining: %d", remaining)
+	if c.rateLimitThreshold < 0 || remaining > c.rateLimitThreshold {
+		return
+	}
+	reset, ok := parseRateLimitReset(resp.Header.Get("X-RateLimit-Reset"), time.Now())
+	if !ok {
+		return
+	}
+	if reset.After(time.Now().Add(maxRetryDelay)) {
+		reset = time.Now().Add(maxRetryDelay)
+	}
+
+	c.pauseMu.Lock()
+	defer c.pauseMu.Unlock()
+	if reset.After(c.pauseUntil) {
+		c.logger.Warnf("only %d requests left in the rate limit, pausing until %s", remaining, reset.Format(time.RFC3339))
+		c.pauseUntil = reset
+	}
+}
+
+// waitForRateLimitReset blocks while the client is paused by observeRateLimit
+func (c *SFXClient) waitForRateLimitReset(ctx context.Context) error {
+	c.pauseMu.Lock()
+	wait := time.Until(c.pauseUntil)
+	c.pauseMu.Unlock()
+	if wait <= 0 {
+		return nil
+	}
+	return sleep(ctx, wait)
+}
+
+// parseRateLimitReset handles X-RateLimit-Reset as epoch seconds, epoch
+// milliseconds, or seconds from now, telling them apart by size
+func parseRateLimitReset(value string, now time.Time) (time.Time, bool) {
+	n, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || n < 0 {
+		return time.Time{}, false
+	}
+	switch {
+	case n > 1e12:
+		return time.Unix(n/1000, (n%1000)*int64(time.Millisecond)), true
+	case n > 1e9:
+		return time.Unix(n, 0), true
+	default:
+		return now.Add(time.Duration(n) * time.Second), true
+	}
+}
+
+// retryBaseDelay is the backoff before the first retry; it doubles per attempt
+const retryBaseDelay = 500 * time.Millisecond
+
+// maxRetryDelay caps both the computed backoff and any Retry-After header
+const maxRetryDelay = 30 * time.Second
+
+// doWithRetry is do, but retries network errors, 429s, and 5xxs up to
+// maxRetries times with exponential backoff and jitter
+func (c *SFXClient) doWithRetry(req *http.Request) (*http.Response, error) {
+	for attempt := 0; ; attempt++ {
+		if attempt > 0 && req.GetBody != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			req.Body = body
+		}
+
+		resp, err := c.do(req)
+		if attempt > 0 {
+			spanFromRequest(req).SetAttribute("retry.count", attempt)
+		}
+		if attempt >= c.maxRetries || req.Context().Err() != nil || !isRetryable(resp, err) {
+			return resp, err
+		}
+
+		delay := retryDelay(attempt, resp)
+		if err != nil {
+			c.logger.Warnf("retrying %s %s in %s after error: %s", req.Method, req.URL.Path, delay, err)
+		} else {
+			c.logger.Warnf("retrying %s %s in %s after StatusCode %d", req.Method, req.URL.Path, delay, resp.StatusCode)
+			resp.Body.Close()
+		}
+		if err := sleep(req.Context(), delay); err != nil {
+			return nil, err
+		}
+	}
+}
+
+func isRetryable(resp *http.Response, err error) bool {
+	if err != nil {
+		return true
+	}
+	return resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500
+}
+
+// retryDelay honors a Retry-After header on 429s, otherwise backs off
+// exponentially from retryBaseDelay with up to 50% jitter
+func retryDelay(attempt int, resp *http.Response) time.Duration {
+	if resp != nil && resp.StatusCode == http.StatusTooManyRequests {
+		if after, ok := parseRetryAfter(resp.Header.Get("Retry-After")); ok {
+			if after > maxRetryDelay {
+				return maxRetryDelay
+			}
+			return after
+		}
+	}
+
+	delay := retryBaseDelay << uint(attempt)
+	if delay > maxRetryDelay || delay <= 0 {
+		delay = maxRetryDelay
+	}
+	return delay + time.Duration(rand.Int63n(int64(delay)/2+1))
+}
+
+// parseRetryAfter handles both forms of Retry-After: delay-seconds and an HTTP date
+func parseRetryAfter(value string) (time.Duration, bool) {
+	if value == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second, true
+	}
+	if at, err := http.ParseTime(value); err == nil {
+		after := time.Until(at)
+		if after < 0 {
+			after = 0
+		}
+		return after, true
+	}
+	return 0, false
+}
+
+// CheckAuth makes a cheap authenticated request, so a bad token, or a token
+// for a different org than the client's, fails the run up front instead of
+// partway through (or, for the wrong org, silently finding nothing)
+func (c *SFXClient) CheckAuth(ctx context.Context) error {
+	org, err := c.Organization(ctx)
+	if err != nil {
+		return err
+	}
+	if c.orgID != org.ID {
+		return fmt.Errorf("SFX_ORG_ID %s doesn't match the token's org %s (%s)", c.orgID, org.ID, org.OrganizationName)
+	}
+	return nil
+}
+
+// Organization (V2 API)
+type Organization struct {
+	ID               string `json:"id"`
+	OrganizationName string `json:"organizationName"`
+}
+
+// Organization gets the org the token belongs to. The result is cached, so
+// only the first call makes a request.
+// https://developers.signalfx.com/reference#retrieve-organization
+func (c *SFXClient) Organization(ctx context.Context) (Organization, error) {
+	c.orgMu.Lock()
+	defer c.orgMu.Unlock()
+	if c.org != nil {
+		return *c.org, nil
+	}
+
+	req, err := c.newRequest(ctx, "GET", "v2/organization", nil)
+	if err != nil {
+		return Organization{}, err
+	}
+
+	resp, err := c.doWithRetry(req)
+	if err != nil {
+		return Organization{}, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		return Organization{}, newAPIError(resp)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return Organization{}, err
+	}
+	org := Organization{}
+	if err := json.Unmarshal(body, &org); err != nil {
+		return Organization{}, newDecodeError(resp, body, err)
+	}
+
+	c.org = &org
+	return org, nil
+}
+
+// Ping checks that the API is reachable and still accepts the client's
+// credentials. Unlike Organization it always makes a request, and it doesn't
+// retry.
+func (c *SFXClient) Ping(ctx context.Context) error {
+	req, err := c.newRequest(ctx, "GET", "v2/organization", nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := c.do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		return newAPIError(resp)
+	}
+	return nil
+}
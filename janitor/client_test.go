@@ -0,0 +1,320 @@
+package janitor
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+const (
+	testToken = "test-token"
+	testOrgID = "test-org"
+)
+
+// newTestClient returns a client for a fake API served by handler. Callers
+// must close the server.
+func newTestClient(handler http.HandlerFunc, configure ...func(*SFXClientConfig)) (*SFXClient, *httptest.Server) {
+	server := httptest.NewServer(handler)
+	cfg := SFXClientConfig{
+		BaseURL: server.URL + "/",
+		Token:   testToken,
+		OrgID:   testOrgID,
+		Logger:  NewLogger(ioutil.Discard, LevelError),
+	}
+	for _, c := range configure {
+		c(&cfg)
+	}
+	return NewSFXClient(cfg), server
+}
+
+// checkRequest fails the test unless r has method and path and carries the test token
+func checkRequest(t *testing.T, r *http.Request, method, path string) {
+	t.Helper()
+	if r.Method != method {
+		t.Errorf("method = %s, want %s", r.Method, method)
+	}
+	if r.URL.Path != path {
+		t.Errorf("path = %s, want %s", r.URL.Path, path)
+	}
+	if token := r.Header.Get("X-SF-TOKEN"); token != testToken {
+		t.Errorf("X-SF-TOKEN = %q, want %q", token, testToken)
+	}
+}
+
+// checkAPIError fails the test unless err is an *APIError with statusCode
+func checkAPIError(t *testing.T, err error, statusCode int) {
+	t.Helper()
+	var apiErr *APIError
+	if !errors.As(err, &apiErr) {
+		t.Fatalf("err = %v, want an *APIError", err)
+	}
+	if apiErr.StatusCode != statusCode {
+		t.Errorf("StatusCode = %d, want %d", apiErr.StatusCode, statusCode)
+	}
+}
+
+func TestListActiveIncidentsV1(t *testing.T) {
+	client, server := newTestClient(func(w http.ResponseWriter, r *http.Request) {
+		checkRequest(t, r, "GET", "/v1/eventtimeseries")
+		q := r.URL.Query()
+		if want := "sf_organizationID:" + testOrgID + " AND (" + DefaultIncidentQuery + ")"; q.Get("query") != want {
+			t.Errorf("query = %q, want %q", q.Get("query"), want)
+		}
+		if q.Get("offset") != "0" || q.Get("limit") != "10" {
+			t.Errorf("offset, limit = %s, %s, want 0, 10", q.Get("offset"), q.Get("limit"))
+		}
+		if q.Get("order_by") != "-sf_priority,-sf_anomalyStateUpdateTimestampMs" {
+			t.Errorf("order_by = %q", q.Get("order_by"))
+		}
+		w.Write([]byte(`{"rs": [{"sf_incidentId": "i1", "sf_detector": "d", "sf_detectorId": "D1", "sf_updatedOnMs": 1000}]}`))
+	})
+	defer server.Close()
+
+	rows, err := client.listActiveIncidentsV1(context.Background(), ListOptions{PageSize: 10, Query: DefaultIncidentQuery})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 1 || rows[0].IncidentID != "i1" || rows[0].SfDetectorID != "D1" {
+		t.Errorf("rows = %+v, want incident i1 of D1", rows)
+	}
+}
+
+func TestListActiveIncidentsV1Error(t *testing.T) {
+	client, server := newTestClient(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, `{"message": "bad query"}`, http.StatusBadRequest)
+	})
+	defer server.Close()
+
+	_, err := client.listActiveIncidentsV1(context.Background(), ListOptions{PageSize: 10, Query: DefaultIncidentQuery})
+	checkAPIError(t, err, http.StatusBadRequest)
+}
+
+func TestClearIncident(t *testing.T) {
+	client, server := newTestClient(func(w http.ResponseWriter, r *http.Request) {
+		checkRequest(t, r, "PUT", "/v2/incident/i1/clear")
+		if r.URL.RawQuery != "" {
+			t.Errorf("query = %q, want none", r.URL.RawQuery)
+		}
+		if body, _ := ioutil.ReadAll(r.Body); len(body) != 0 {
+			t.Errorf("body = %q, want none", body)
+		}
+	})
+	defer server.Close()
+
+	if err := client.ClearIncident(context.Background(), "i1"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestClearIncidentErrors(t *testing.T) {
+	for _, tc := range []struct {
+		name       string
+		statusCode int
+		body       string
+		cleared    bool
+	}{
+		{name: "forbidden", statusCode: http.StatusForbidden, body: `{"message": "no"}`},
+		{name: "server error", statusCode: http.StatusInternalServerError, body: "oops"},
+		{name: "not found", statusCode: http.StatusNotFound, cleared: true},
+		{name: "not active", statusCode: http.StatusBadRequest, body: `{"message": "Incident is not active"}`, cleared: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			client, server := newTestClient(func(w http.ResponseWriter, r *http.Request) {
+				checkRequest(t, r, "PUT", "/v2/incident/i1/clear")
+				http.Error(w, tc.body, tc.statusCode)
+			})
+			defer server.Close()
+
+			err := client.ClearIncident(context.Background(), "i1")
+			if tc.cleared {
+				if !errors.Is(err, ErrAlreadyCleared) {
+					t.Errorf("err = %v, want ErrAlreadyCleared", err)
+				}
+				return
+			}
+			checkAPIError(t, err, tc.statusCode)
+		})
+	}
+}
+
+// mutingRequest is the body CreateMuting sends
+type mutingRequest struct {
+	Filters     []AlertMutingFilter `json:"filters"`
+	StartTime   int64               `json:"startTime"`
+	StopTime    int64               `json:"stopTime"`
+	Description string              `json:"description"`
+}
+
+// mutingHandler serves CreateMuting with statusCode, saving each body it gets in got
+func mutingHandler(t *testing.T, statusCode int, got *[]mutingRequest) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		checkRequest(t, r, "POST", "/v2/alertmuting")
+		if r.Header.Get("Content-Type") != "application/json" {
+			t.Errorf("Content-Type = %q", r.Header.Get("Content-Type"))
+		}
+		var body mutingRequest
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			t.Errorf("error decoding body: %s", err)
+		}
+		*got = append(*got, body)
+		w.WriteHeader(statusCode)
+	}
+}
+
+func TestCreateMuting(t *testing.T) {
+	var got []mutingRequest
+	client, server := newTestClient(mutingHandler(t, http.StatusCreated, &got))
+	defer server.Close()
+
+	start := time.Unix(1600000000, 0)
+	stop := start.Add(time.Hour)
+	filters := []AlertMutingFilter{DetectorFilter("D1"), {Property: "env", PropertyValue: "staging"}}
+	if err := client.CreateMuting(context.Background(), filters, start, stop, "deploy"); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(got) != 1 {
+		t.Fatalf("got %d requests, want 1", len(got))
+	}
+	body := got[0]
+	if body.StartTime != 1600000000000 || body.StopTime != 1600003600000 {
+		t.Errorf("startTime, stopTime = %d, %d", body.StartTime, body.StopTime)
+	}
+	if body.Description != "deploy" {
+		t.Errorf("description = %q", body.Description)
+	}
+	if len(body.Filters) != 2 || body.Filters[0] != filters[0] || body.Filters[1] != filters[1] {
+		t.Errorf("filters = %+v, want %+v", body.Filters, filters)
+	}
+}
+
+func TestCreateMutingError(t *testing.T) {
+	var got []mutingRequest
+	client, server := newTestClient(mutingHandler(t, http.StatusBadRequest, &got))
+	defer server.Close()
+
+	start := time.Now()
+	err := client.CreateMuting(context.Background(), nil, start, start.Add(time.Hour), "")
+	checkAPIError(t, err, http.StatusBadRequest)
+}
+
+func TestMuteDetector(t *testing.T) {
+	var got []mutingRequest
+	client, server := newTestClient(mutingHandler(t, http.StatusCreated, &got))
+	defer server.Close()
+
+	start := time.Now()
+	err := muteDetector(context.Background(), client, "D1", MuteOptions{
+		Start:       start,
+		Stop:        start.Add(time.Hour),
+		Description: "deploy",
+		Force:       true,
+		MaxDuration: DefaultMaxMuteDuration,
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(got) != 1 {
+		t.Fatalf("got %d requests, want 1", len(got))
+	}
+	if len(got[0].Filters) != 1 || got[0].Filters[0] != DetectorFilter("D1") {
+		t.Errorf("filters = %+v, want only the detector", got[0].Filters)
+	}
+	if got[0].Description != "Muted by signalfx-janitor: deploy" {
+		t.Errorf("description = %q", got[0].Description)
+	}
+}
+
+func TestMuteDetectorError(t *testing.T) {
+	var got []mutingRequest
+	client, server := newTestClient(mutingHandler(t, http.StatusForbidden, &got))
+	defer server.Close()
+
+	start := time.Now()
+	err := muteDetector(context.Background(), client, "D1", MuteOptions{Start: start, Stop: start.Add(time.Hour), Force: true}, nil)
+	checkAPIError(t, err, http.StatusForbidden)
+}
+
+func TestTimeout(t *testing.T) {
+	client, server := newTestClient(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(time.Second):
+		}
+	}, func(cfg *SFXClientConfig) {
+		cfg.Timeout = 20 * time.Millisecond
+	})
+	defer server.Close()
+
+	start := time.Now()
+	err := client.ClearIncident(context.Background(), "i1")
+	var netErr net.Error
+	if !errors.As(err, &netErr) || !netErr.Timeout() {
+		t.Fatalf("err = %v, want a timeout", err)
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("took %s to time out", elapsed)
+	}
+}
+
+func TestRetryThenSucceed(t *testing.T) {
+	attempts := 0
+	client, server := newTestClient(func(w http.ResponseWriter, r *http.Request) {
+		checkRequest(t, r, "PUT", "/v2/incident/i1/clear")
+		attempts++
+		if attempts <= 2 {
+			w.Header().Set("Retry-After", "0")
+			http.Error(w, "slow down", http.StatusTooManyRequests)
+		}
+	}, func(cfg *SFXClientConfig) {
+		cfg.MaxRetries = 3
+	})
+	defer server.Close()
+
+	if err := client.ClearIncident(context.Background(), "i1"); err != nil {
+		t.Fatal(err)
+	}
+	if attempts != 3 {
+		t.Errorf("attempts = %d, want 3", attempts)
+	}
+}
+
+func TestListAlertMutings(t *testing.T) {
+	requests := 0
+	client, server := newTestClient(func(w http.ResponseWriter, r *http.Request) {
+		checkRequest(t, r, "GET", "/v2/alertmuting")
+		requests++
+		if requests == 1 {
+			http.Error(w, "bad gateway", http.StatusBadGateway)
+			return
+		}
+		if q := r.URL.Query().Get("query"); q != "sf_detectorId:D1" {
+			t.Errorf("query = %q, want sf_detectorId:D1", q)
+		}
+		w.Write([]byte(`{"count": 2, "results": [
+			{"id": "m1", "filters": [{"property": "sf_detectorId", "propertyValue": "D1"}]},
+			{"id": "m2", "filters": [{"property": "sf_detectorId", "propertyValue": "D2"}]}
+		]}`))
+	}, func(cfg *SFXClientConfig) {
+		cfg.MaxRetries = 3
+	})
+	defer server.Close()
+
+	mutings, err := client.ListAlertMutings(context.Background(), "D1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(mutings) != 1 || mutings[0].ID != "m1" {
+		t.Errorf("mutings = %+v, want only m1", mutings)
+	}
+	if requests != 2 {
+		t.Errorf("requests = %d, want 2", requests)
+	}
+}
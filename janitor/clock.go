@@ -0,0 +1,38 @@
+package janitor
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+)
+
+// ServerTime estimates the API's current time from the Date header of a
+// request to it, for hosts whose clocks can't be trusted. The header only
+// has whole seconds, so the estimate is good to about half a second plus
+// half the round trip.
+func (c *SFXClient) ServerTime(ctx context.Context) (time.Time, error) {
+	req, err := c.newRequest(ctx, "GET", "v2/organization", nil)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	sent := time.Now()
+	resp, err := c.do(req)
+	if err != nil {
+		return time.Time{}, err
+	}
+	defer resp.Body.Close()
+	received := time.Now()
+
+	if resp.StatusCode != 200 {
+		return time.Time{}, newAPIError(resp)
+	}
+	date, err := http.ParseTime(resp.Header.Get("Date"))
+	if err != nil {
+		return time.Time{}, errors.New("response has no valid Date header")
+	}
+	// the server truncated its time to the second somewhere mid-request
+	offset := date.Add(500 * time.Millisecond).Sub(sent.Add(received.Sub(sent) / 2))
+	return time.Now().Add(offset), nil
+}
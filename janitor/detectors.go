@@ -0,0 +1,278 @@
+package janitor
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Detector (V2 API)
+type Detector struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+	// Teams are the IDs of the teams the detector is linked to
+	Teams []string `json:"teams,omitempty"`
+}
+
+// Detectors (V2 API)
+type Detectors struct {
+	Count   int        `json:"count"`
+	Results []Detector `json:"results"`
+}
+
+// detectorPageSize is how many detectors are requested at a time
+const detectorPageSize = 100
+
+// ListDetectorsByName pages through the detectors whose names match name, or
+// all detectors if name is empty. SignalFX matches partial names, so callers
+// wanting an exact match should check.
+func (c *SFXClient) ListDetectorsByName(ctx context.Context, name string) ([]Detector, error) {
+	all := []Detector{}
+	for offset := 0; ; offset += detectorPageSize {
+		page, err := c.listDetectorsPage(ctx, name, offset, detectorPageSize)
+		if err != nil {
+			return []Detector{}, err
+		}
+		all = append(all, page...)
+		if len(page) < detectorPageSize {
+			return all, nil
+		}
+	}
+}
+
+// https://developers.signalfx.com/detectors_reference.html#operation/Retrieve%20Detectors%20Query
+func (c *SFXClient) listDetectorsPage(ctx context.Context, name string, offset, limit int) ([]Detector, error) {
+	req, err := c.newRequest(ctx, "GET", "v2/detector", nil)
+	if err != nil {
+		return []Detector{}, err
+	}
+	q := req.URL.Query()
+	if name != "" {
+		q.Add("name", name)
+	}
+	q.Add("offset", strconv.Itoa(offset))
+	q.Add("limit", strconv.Itoa(limit))
+	req.URL.RawQuery = q.Encode()
+
+	resp, err := c.doWithRetry(req)
+	if err != nil {
+		return []Detector{}, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		return []Detector{}, newAPIError(resp)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return []Detector{}, err
+	}
+	detectors := new(Detectors)
+	if err := json.Unmarshal(body, &detectors); err != nil {
+		return []Detector{}, newDecodeError(resp, body, err)
+	}
+	return detectors.Results, nil
+}
+
+// Detector types, see FillDetectorTypes
+const (
+	DetectorTypeV1 = "v1"
+	DetectorTypeV2 = "v2"
+)
+
+// FillDetectorTypes sets the DetectorType of each incident, looking each
+// detector up once. The v2 detector API doesn't know v1 detectors, so one it
+// can't find is taken to be a v1 detector.
+func FillDetectorTypes(ctx context.Context, client *SFXClient, incidents []SimpleIncident) error {
+	types := map[string]string{}
+	for n, i := range incidents {
+		if i.DetectorID == "" {
+			continue
+		}
+		if _, ok := types[i.DetectorID]; !ok {
+			isV2, err := client.detectorExists(ctx, i.DetectorID)
+			if err != nil {
+				return fmt.Errorf("error looking up detector %s: %w", i.DetectorID, err)
+			}
+			types[i.DetectorID] = DetectorTypeV1
+			if isV2 {
+				types[i.DetectorID] = DetectorTypeV2
+			}
+		}
+		incidents[n].DetectorType = types[i.DetectorID]
+	}
+	return nil
+}
+
+// detectorExists reports whether the v2 detector API knows detectorID
+func (c *SFXClient) detectorExists(ctx context.Context, detectorID string) (bool, error) {
+	detector, err := c.getDetector(ctx, detectorID)
+	return detector != nil, err
+}
+
+// detectorDetails is the part of a v2 detector ListDetectorsByName doesn't need
+type detectorDetails struct {
+	Detector
+	ProgramText string `json:"programText"`
+}
+
+// getDetector gets detectorID from the v2 detector API, or nil if it
+// doesn't know it
+// https://developers.signalfx.com/detectors_reference.html#operation/Retrieve%20Detector
+func (c *SFXClient) getDetector(ctx context.Context, detectorID string) (*detectorDetails, error) {
+	req, err := c.newRequest(ctx, "GET", "v2/detector/"+detectorID, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := c.doWithRetry(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		if err := newAPIError(resp); !isNotFound(err) {
+			return nil, err
+		}
+		return nil, nil
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	detector := new(detectorDetails)
+	if err := json.Unmarshal(body, detector); err != nil {
+		return nil, newDecodeError(resp, body, err)
+	}
+	return detector, nil
+}
+
+// FillDetectorDurations sets the DetectorDuration of each incident, looking
+// each detector up once. Incidents whose detector is a v1 detector, or has no
+// lasting duration, are left at zero.
+func FillDetectorDurations(ctx context.Context, client *SFXClient, incidents []SimpleIncident) error {
+	durations := map[string]time.Duration{}
+	for n, i := range incidents {
+		if i.DetectorID == "" {
+			continue
+		}
+		if _, ok := durations[i.DetectorID]; !ok {
+			detector, err := client.getDetector(ctx, i.DetectorID)
+			if err != nil {
+				return fmt.Errorf("error looking up detector %s: %w", i.DetectorID, err)
+			}
+			if detector != nil {
+				durations[i.DetectorID] = programDuration(detector.ProgramText)
+			}
+			client.logger.Debugf("Detector %s lasts %s", i.Label(), durations[i.DetectorID])
+		}
+		incidents[n].DetectorDuration = durations[i.DetectorID]
+	}
+	return nil
+}
+
+// lastingPattern finds the durations in SignalFlow like
+// when(A > 5, lasting='5m') or lasting=duration("1h30m")
+var lastingPattern = regexp.MustCompile(`lasting\s*=\s*(?:duration\(\s*)?['"]([0-9smhdw]+)['"]`)
+
+// programDuration is the longest lasting duration in a detector's
+// SignalFlow program, or zero if it has none
+func programDuration(programText string) time.Duration {
+	longest := time.Duration(0)
+	for _, match := range lastingPattern.FindAllStringSubmatch(programText, -1) {
+		if d, ok := parseSignalFlowDuration(match[1]); ok && d > longest {
+			longest = d
+		}
+	}
+	return longest
+}
+
+// signalFlowUnits are the units of SignalFlow durations, which unlike Go's
+// include days and weeks
+var signalFlowUnits = map[byte]time.Duration{
+	's': time.Second,
+	'm': time.Minute,
+	'h': time.Hour,
+	'd': 24 * time.Hour,
+	'w': 7 * 24 * time.Hour,
+}
+
+// parseSignalFlowDuration parses durations like "5m" or "1h30m"
+func parseSignalFlowDuration(s string) (time.Duration, bool) {
+	total, number := time.Duration(0), ""
+	for n := 0; n < len(s); n++ {
+		if s[n] >= '0' && s[n] <= '9' {
+			number += s[n : n+1]
+			continue
+		}
+		unit, ok := signalFlowUnits[s[n]]
+		if !ok || number == "" {
+			return 0, false
+		}
+		count, err := strconv.Atoi(number)
+		if err != nil {
+			return 0, false
+		}
+		total += time.Duration(count) * unit
+		number = ""
+	}
+	if number != "" {
+		return 0, false
+	}
+	return total, true
+}
+
+// DetectorsNameContains gets the detectors whose names contain substr,
+// case-insensitively
+func DetectorsNameContains(ctx context.Context, client *SFXClient, substr string) ([]Detector, error) {
+	detectors, err := client.ListDetectorsByName(ctx, substr)
+	if err != nil {
+		return []Detector{}, err
+	}
+	matching := []Detector{}
+	for _, d := range detectors {
+		if strings.Contains(strings.ToLower(d.Name), strings.ToLower(substr)) {
+			matching = append(matching, d)
+		}
+	}
+	return matching, nil
+}
+
+// DetectorIDByName finds the ID of the detector called name. An exact
+// (case-insensitive) match wins; otherwise name must match exactly one
+// detector. It's an error for none or several to match.
+func DetectorIDByName(ctx context.Context, client *SFXClient, name string) (string, error) {
+	detectors, err := client.ListDetectorsByName(ctx, name)
+	if err != nil {
+		return "", err
+	}
+
+	exact := []Detector{}
+	for _, d := range detectors {
+		if strings.EqualFold(d.Name, name) {
+			exact = append(exact, d)
+		}
+	}
+	if len(exact) > 0 {
+		detectors = exact
+	}
+
+	switch len(detectors) {
+	case 0:
+		return "", fmt.Errorf("no detector named %q", name)
+	case 1:
+		return detectors[0].ID, nil
+	default:
+		candidates := []string{}
+		for _, d := range detectors {
+			candidates = append(candidates, fmt.Sprintf("%q (%s)", d.Name, d.ID))
+		}
+		return "", fmt.Errorf("%d detectors match %q: %s", len(detectors), name, strings.Join(candidates, ", "))
+	}
+}
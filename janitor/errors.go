@@ -0,0 +1,159 @@
+package janitor
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+)
+
+// APIError is returned when the SignalFX API responds with an unexpected status
+type APIError struct {
+	StatusCode int
+	Method     string
+	Path       string
+	Body       string
+	// Message and Code are parsed from SignalFX's JSON error body, when it has one
+	Message string
+	Code    string
+}
+
+func (e *APIError) Error() string {
+	msg := fmt.Sprintf("%s %s got StatusCode %d", e.Method, e.Path, e.StatusCode)
+	switch e.StatusCode {
+	case http.StatusUnauthorized:
+		msg += " (auth failed: SFX_TOKEN is invalid or expired)"
+	case http.StatusForbidden:
+		msg += " (auth failed: SFX_TOKEN lacks permission for this request)"
+	}
+	if e.Message != "" {
+		if e.Code != "" {
+			return fmt.Sprintf("%s: %s (code %s)", msg, e.Message, e.Code)
+		}
+		return msg + ": " + e.Message
+	}
+	return msg + ": " + truncateBody(e.Body)
+}
+
+// truncateBody trims body to at most maxErrorBody bytes for error messages
+func truncateBody(body string) string {
+	body = strings.TrimSpace(body)
+	if len(body) > maxErrorBody {
+		body = body[:maxErrorBody] + "..."
+	}
+	return body
+}
+
+// newDecodeError wraps err, the failure to decode resp's body, with what the
+// server actually sent, e.g. to show an HTML error page from a proxy
+func newDecodeError(resp *http.Response, body []byte, err error) error {
+	return fmt.Errorf("error decoding %s %s response (StatusCode %d, Content-Type %q): %w: %s",
+		resp.Request.Method, resp.Request.URL, resp.StatusCode, resp.Header.Get("Content-Type"), err, truncateBody(string(body)))
+}
+
+// maxErrorBody caps how much of a response body an APIError message includes,
+// since error pages from proxies can be long HTML documents
+const maxErrorBody = 512
+
+// newAPIError reads the rest of resp's body into an APIError
+func newAPIError(resp *http.Response) error {
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	apiErr := &APIError{
+		StatusCode: resp.StatusCode,
+		Method:     resp.Request.Method,
+		Path:       resp.Request.URL.Path,
+		Body:       string(body),
+	}
+
+	// SignalFX error bodies look like {"code": 400, "message": "..."}, with
+	// code sometimes a string. Anything else is left as just Body.
+	parsed := struct {
+		Code    json.RawMessage `json:"code"`
+		Message string          `json:"message"`
+	}{}
+	if json.Unmarshal(body, &parsed) == nil {
+		apiErr.Message = parsed.Message
+		if code := strings.Trim(string(parsed.Code), `"`); code != "null" {
+			apiErr.Code = code
+		}
+	}
+	return apiErr
+}
+
+// isNotFound reports whether err is an APIError for a 404
+func isNotFound(err error) bool {
+	var apiErr *APIError
+	return errors.As(err, &apiErr) && apiErr.StatusCode == http.StatusNotFound
+}
+
+// IsUnauthorized reports whether err is an APIError for a 401, which is also
+// what the API answers tokens from another realm with
+func IsUnauthorized(err error) bool {
+	var apiErr *APIError
+	return errors.As(err, &apiErr) && apiErr.StatusCode == http.StatusUnauthorized
+}
+
+// ErrAlreadyCleared is wrapped by ClearIncident's error when the incident
+// was already cleared, e.g. by an earlier attempt of a retried request whose
+// response was lost
+var ErrAlreadyCleared = errors.New("incident already cleared")
+
+// isAlreadyCleared reports whether err is SignalFX refusing to clear an
+// incident that isn't active anymore: a 404, or a 400 or 409 saying so
+func isAlreadyCleared(err error) bool {
+	if isNotFound(err) {
+		return true
+	}
+	var apiErr *APIError
+	if !errors.As(err, &apiErr) {
+		return false
+	}
+	if apiErr.StatusCode != http.StatusBadRequest && apiErr.StatusCode != http.StatusConflict {
+		return false
+	}
+	msg := strings.ToLower(apiErr.Message + " " + apiErr.Body)
+	for _, s := range []string{"already cleared", "already resolved", "not active"} {
+		if strings.Contains(msg, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// MultiError collects independent failures, e.g. one per incident.
+// errors.Is and errors.As look through it at each failure, so callers can
+// still find e.g. the *APIError of one.
+type MultiError []error
+
+func (m MultiError) Error() string {
+	msgs := make([]string, len(m))
+	for i, err := range m {
+		msgs[i] = err.Error()
+	}
+	return strings.Join(msgs, "; ")
+}
+
+// Is reports whether any of the failures is target
+func (m MultiError) Is(target error) bool {
+	for _, err := range m {
+		if errors.Is(err, target) {
+			return true
+		}
+	}
+	return false
+}
+
+// As finds the first of the failures that matches target
+func (m MultiError) As(target interface{}) bool {
+	for _, err := range m {
+		if errors.As(err, target) {
+			return true
+		}
+	}
+	return false
+}
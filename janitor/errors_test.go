@@ -0,0 +1,61 @@
+package janitor
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func TestMultiError(t *testing.T) {
+	apiErr := &APIError{StatusCode: 503, Method: "PUT", Path: "/v2/incident/i2/clear", Body: "unavailable"}
+	cleared := fmt.Errorf("%w: PUT /v2/incident/i3/clear got StatusCode 404", ErrAlreadyCleared)
+	plain := errors.New("error muting detector D1")
+
+	for _, tc := range []struct {
+		name        string
+		err         error
+		statusCode  int // of the *APIError errors.As should find, or 0 for none
+		cleared     bool
+		wantMessage string
+	}{
+		{
+			name:        "api error",
+			err:         MultiError{plain, fmt.Errorf("error resolving incident i2: %w", apiErr)},
+			statusCode:  503,
+			wantMessage: "error muting detector D1; error resolving incident i2: " + apiErr.Error(),
+		},
+		{
+			name:        "already cleared",
+			err:         MultiError{cleared, plain},
+			cleared:     true,
+			wantMessage: cleared.Error() + "; error muting detector D1",
+		},
+		{
+			name:        "both, wrapped",
+			err:         fmt.Errorf("error resolving incidents: %w", MultiError{apiErr, cleared, plain}),
+			statusCode:  503,
+			cleared:     true,
+			wantMessage: "error resolving incidents: " + apiErr.Error() + "; " + cleared.Error() + "; error muting detector D1",
+		},
+		{
+			name:        "neither",
+			err:         MultiError{plain, errors.New("timeout")},
+			wantMessage: "error muting detector D1; timeout",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var found *APIError
+			if errors.As(tc.err, &found) != (tc.statusCode != 0) {
+				t.Errorf("errors.As found %v, want StatusCode %d", found, tc.statusCode)
+			} else if found != nil && found.StatusCode != tc.statusCode {
+				t.Errorf("errors.As found StatusCode %d, want %d", found.StatusCode, tc.statusCode)
+			}
+			if errors.Is(tc.err, ErrAlreadyCleared) != tc.cleared {
+				t.Errorf("errors.Is(ErrAlreadyCleared) = %v, want %v", !tc.cleared, tc.cleared)
+			}
+			if msg := tc.err.Error(); msg != tc.wantMessage {
+				t.Errorf("Error() = %q, want %q", msg, tc.wantMessage)
+			}
+		})
+	}
+}
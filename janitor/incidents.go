@@ -0,0 +1,528 @@
+package janitor
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// SimpleIncident represents a SignalFX incident
+type SimpleIncident struct {
+	DetectorName string
+	DetectorID   string
+	ID           string
+	// CreatedAt is when the incident first fired, and UpdatedAt when it last
+	// changed. Staleness goes by UpdatedAt.
+	CreatedAt time.Time
+	UpdatedAt time.Time
+	Severity  Severity
+	// Priority is the v1 sf_priority, 0 (lowest) through 4, or
+	// PriorityUnknown. v2 incidents have no sf_priority, so theirs is
+	// derived from Severity.
+	Priority int
+	// DetectorType is DetectorTypeV1 or DetectorTypeV2 once filled in by
+	// FillDetectorTypes, and "" before
+	DetectorType string
+	// DetectorDuration is how long the detector's condition must last
+	// before it fires, once filled in by FillDetectorDurations, or zero if
+	// unknown
+	DetectorDuration time.Duration
+	// Muted is whether a muting is in effect for the incident's detector,
+	// once filled in by FillMuted
+	Muted bool
+	// New is whether the incident wasn't active the last time incidents
+	// were listed. It's up to callers to remember that and fill it in.
+	New bool
+}
+
+// Label names the incident's detector for people, as "name -- id"
+func (si SimpleIncident) Label() string {
+	return fmt.Sprint(si.DetectorName, " -- ", si.DetectorID)
+}
+
+func (si SimpleIncident) String() string {
+	timeAgo := time.Now().Sub(si.UpdatedAt)
+	return fmt.Sprintf("%s [%s] (time ago = %s)", si.Label(), si.Severity, timeAgo)
+}
+
+// AgeBucket counts incidents whose age is below Max, and at or above the
+// previous bucket's Max. The last bucket has no Max.
+type AgeBucket struct {
+	Label string        `json:"bucket"`
+	Max   time.Duration `json:"-"`
+	Count int           `json:"count"`
+}
+
+// ageBuckets are the buckets AgeDistribution sorts incidents into
+var ageBuckets = []AgeBucket{
+	{Label: "<30m", Max: 30 * time.Minute},
+	{Label: "30m-2h", Max: 2 * time.Hour},
+	{Label: "2h-1d", Max: 24 * time.Hour},
+	{Label: ">1d"},
+}
+
+// AgeDistribution counts incidents by how long ago they were last updated,
+// which helps pick a sensible stale-after
+func AgeDistribution(incidents []SimpleIncident, now time.Time) []AgeBucket {
+	buckets := append([]AgeBucket{}, ageBuckets...)
+	for _, i := range incidents {
+		age := now.Sub(i.UpdatedAt)
+		for n := range buckets {
+			if buckets[n].Max == 0 || age < buckets[n].Max {
+				buckets[n].Count++
+				break
+			}
+		}
+	}
+	return buckets
+}
+
+// Severity is a SignalFX alert severity, ordered from least to most severe
+type Severity int
+
+// Severities in increasing order. SeverityUnknown sorts below everything.
+const (
+	SeverityUnknown Severity = iota
+	SeverityInfo
+	SeverityWarning
+	SeverityMinor
+	SeverityMajor
+	SeverityCritical
+)
+
+var severityNames = []string{"Unknown", "Info", "Warning", "Minor", "Major", "Critical"}
+
+func (s Severity) String() string {
+	if s < 0 || int(s) >= len(severityNames) {
+		return severityNames[SeverityUnknown]
+	}
+	return severityNames[s]
+}
+
+// ParseSeverity parses a severity name, case-insensitively
+func ParseSeverity(name string) (Severity, error) {
+	for i, n := range severityNames {
+		if i != int(SeverityUnknown) && strings.EqualFold(n, name) {
+			return Severity(i), nil
+		}
+	}
+	return SeverityUnknown, fmt.Errorf("unknown severity %q", name)
+}
+
+// PriorityUnknown is the Priority of incidents without a known sf_priority
+const PriorityUnknown = -1
+
+// v1Priority is a v1 sf_priority as an int, or PriorityUnknown
+func v1Priority(priority *float64) int {
+	if priority == nil || *priority < 0 || *priority > 4 {
+		return PriorityUnknown
+	}
+	return int(*priority)
+}
+
+// severityToPriority is the inverse of priorityToSeverity
+func severityToPriority(severity Severity) int {
+	if severity == SeverityUnknown {
+		return PriorityUnknown
+	}
+	return int(severity - SeverityInfo)
+}
+
+// priorityToSeverity maps a v1 sf_priority (0 = Info through 4 = Critical).
+// A missing priority is SeverityUnknown.
+func priorityToSeverity(priority *float64) Severity {
+	if priority == nil || *priority < 0 || *priority > 4 {
+		return SeverityUnknown
+	}
+	return SeverityInfo + Severity(*priority)
+}
+
+// GetV1Incidents gets an array of SimpleIncidents. An incident can span
+// several time series; it's returned once, as of its latest update.
+func GetV1Incidents(ctx context.Context, client *SFXClient, opts ListOptions) ([]SimpleIncident, error) {
+	eventTimeSeries, err := client.listActiveIncidentsV1(ctx, opts)
+	if err != nil {
+		return []SimpleIncident{}, err
+	}
+
+	incidents := []SimpleIncident{}
+	seen := map[string]int{} // incident ID to index in incidents
+	for _, series := range eventTimeSeries {
+		incident := SimpleIncident{
+			ID:           series.IncidentID,
+			CreatedAt:    time.Unix(int64(series.CreatedOnMs/1000), 0),
+			UpdatedAt:    time.Unix(int64(series.UpdatedOnMs/1000), 0),
+			DetectorName: series.SfDetector,
+			DetectorID:   series.SfDetectorID,
+			Severity:     priorityToSeverity(series.SfPriority),
+			Priority:     v1Priority(series.SfPriority),
+		}
+		if series.CreatedOnMs == 0 {
+			incident.CreatedAt = incident.UpdatedAt
+		}
+		if n, ok := seen[incident.ID]; ok {
+			if incident.UpdatedAt.After(incidents[n].UpdatedAt) {
+				incidents[n] = incident
+			}
+			continue
+		}
+		seen[incident.ID] = len(incidents)
+		incidents = append(incidents, incident)
+	}
+
+	if opts.Limit > 0 && len(incidents) > opts.Limit {
+		incidents = incidents[:opts.Limit]
+	}
+	return incidents, nil
+}
+
+// GetV2Incidents gets an array of SimpleIncidents from the v2 incident API,
+// each incident once
+func GetV2Incidents(ctx context.Context, client *SFXClient, opts ListOptions) ([]SimpleIncident, error) {
+	v2Incidents, err := client.listActiveIncidentsV2(ctx, opts)
+	if err != nil {
+		return []SimpleIncident{}, err
+	}
+
+	incidents := []SimpleIncident{}
+	seen := map[string]bool{}
+	since := time.Now().Add(-opts.Since)
+	for _, incident := range v2Incidents {
+		if seen[incident.IncidentID] {
+			continue
+		}
+		seen[incident.IncidentID] = true
+		if opts.Since > 0 && msToTime(incident.lastEventMs()).Before(since) {
+			continue
+		}
+		severity, _ := ParseSeverity(incident.Severity)
+		incidents = append(incidents, SimpleIncident{
+			ID:           incident.IncidentID,
+			CreatedAt:    msToTime(incident.firstEventMs()),
+			UpdatedAt:    msToTime(incident.lastEventMs()),
+			DetectorName: incident.DetectorName,
+			DetectorID:   incident.DetectorID,
+			Severity:     severity,
+			Priority:     severityToPriority(severity),
+		})
+		if opts.Limit > 0 && len(incidents) == opts.Limit {
+			break
+		}
+	}
+
+	return incidents, nil
+}
+
+// ListOptions controls how active incidents are listed
+type ListOptions struct {
+	// APIVersion is the incident API to list from, "v1" or "v2"
+	APIVersion string
+	// PageSize is the number of incidents requested at a time. Defaults to
+	// DefaultPageSize.
+	PageSize int
+	// Limit, if positive, caps how many incidents are listed. Paging stops
+	// once that many have been fetched.
+	Limit int
+	// Query is the v1 Lucene query matching active incidents. It is always
+	// scoped to the client's org. Defaults to DefaultIncidentQuery.
+	Query string
+	// DetectorQuery, if set, is a v1 query clause ANDed onto Query to only
+	// list some detectors' incidents server-side, see DetectorQuery
+	DetectorQuery string
+	// Since, if positive, only lists incidents updated within that long of now.
+	// v1 filters server-side; v2 has no such filter, so it's applied after listing.
+	Since time.Duration
+}
+
+// DefaultPageSize is how many incidents are requested at a time unless
+// ListOptions.PageSize says otherwise
+const DefaultPageSize = 500
+
+// DefaultIncidentQuery matches every anomalous incident in the org
+const DefaultIncidentQuery = `(NOT sf_archived:true) AND ((((sf_anomalyState:("anomalous" "too high" "too low"))) AND (sf_detector.lowercase:* OR sf_displayName.lowercase:*)))`
+
+// DefaultAnomalyStates are the anomaly states DefaultIncidentQuery treats as active
+var DefaultAnomalyStates = []string{"anomalous", "too high", "too low"}
+
+// anomalyStates are the values SignalFX uses for sf_anomalyState
+var anomalyStates = map[string]bool{
+	"ok":                true,
+	"anomalous":         true,
+	"too high":          true,
+	"too low":           true,
+	"manually resolved": true,
+	"stopped":           true,
+}
+
+// IncidentQuery is DefaultIncidentQuery matching the given anomaly states
+// instead of DefaultAnomalyStates
+func IncidentQuery(states []string) (string, error) {
+	if len(states) == 0 {
+		return "", errors.New("at least one anomaly state is required")
+	}
+	quoted := []string{}
+	for _, state := range states {
+		if !anomalyStates[state] {
+			return "", fmt.Errorf("unknown anomaly state %q", state)
+		}
+		quoted = append(quoted, strconv.Quote(state))
+	}
+	return `(NOT sf_archived:true) AND ((((sf_anomalyState:(` + strings.Join(quoted, " ") + `))) AND (sf_detector.lowercase:* OR sf_displayName.lowercase:*)))`, nil
+}
+
+// detectorIDPattern is what SignalFX detector IDs look like
+var detectorIDPattern = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// DetectorQuery is a v1 query clause matching the incidents of the detectors
+// with the given IDs or names, for ListOptions.DetectorQuery. IDs must look
+// like detector IDs; names are quoted, so they match exactly.
+func DetectorQuery(ids, names []string) (string, error) {
+	clauses := []string{}
+	if len(ids) > 0 {
+		quoted := []string{}
+		for _, id := range ids {
+			if !detectorIDPattern.MatchString(id) {
+				return "", fmt.Errorf("invalid detector ID %q", id)
+			}
+			quoted = append(quoted, luceneQuote(id))
+		}
+		clauses = append(clauses, "sf_detectorId:("+strings.Join(quoted, " ")+")")
+	}
+	if len(names) > 0 {
+		quoted := []string{}
+		for _, name := range names {
+			if name == "" {
+				return "", errors.New("detector names can't be empty")
+			}
+			quoted = append(quoted, luceneQuote(name))
+		}
+		clauses = append(clauses, "sf_detector:("+strings.Join(quoted, " ")+")")
+	}
+	if len(clauses) == 0 {
+		return "", errors.New("at least one detector ID or name is required")
+	}
+	return "(" + strings.Join(clauses, " OR ") + ")", nil
+}
+
+// luceneQuote makes s a Lucene phrase, escaping the characters that would
+// end it early
+func luceneQuote(s string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s) + `"`
+}
+
+// GetIncidents lists active incidents using the API version in opts
+func GetIncidents(ctx context.Context, client *SFXClient, opts ListOptions) ([]SimpleIncident, error) {
+	switch opts.APIVersion {
+	case "v1":
+		return GetV1Incidents(ctx, client, opts)
+	case "v2":
+		return GetV2Incidents(ctx, client, opts)
+	default:
+		return []SimpleIncident{}, fmt.Errorf("unknown api-version %q", opts.APIVersion)
+	}
+}
+
+// EventTimeSeries (V1 API)
+type EventTimeSeries struct {
+	RS []EventTimeSeriesRS `json:"rs"`
+}
+
+// EventTimeSeriesRS (V1 API)
+type EventTimeSeriesRS struct {
+	IncidentID   string   `json:"sf_incidentId"`
+	CreatedOnMs  float64  `json:"sf_createdOnMs"`
+	UpdatedOnMs  float64  `json:"sf_updatedOnMs"`
+	SfDetector   string   `json:"sf_detector"`
+	SfDetectorID string   `json:"sf_detectorId"`
+	SfPriority   *float64 `json:"sf_priority"`
+}
+
+// listActiveIncidentsV1 pages through all active incidents, opts.PageSize at a time
+func (c *SFXClient) listActiveIncidentsV1(ctx context.Context, opts ListOptions) (all []EventTimeSeriesRS, err error) {
+	ctx, span := c.startSpan(ctx, "listActiveIncidentsV1")
+	defer func() {
+		span.SetAttribute("incidents.count", len(all))
+		span.End(err)
+	}()
+
+	query := opts.Query
+	if query == "" {
+		query = DefaultIncidentQuery
+	}
+	if opts.DetectorQuery != "" {
+		query = fmt.Sprintf("(%s) AND %s", query, opts.DetectorQuery)
+	}
+	if opts.Since > 0 {
+		sinceMs := time.Now().Add(-opts.Since).UnixNano() / int64(time.Millisecond)
+		query = fmt.Sprintf("(%s) AND sf_updatedOnMs:[%d TO *]", query, sinceMs)
+	}
+
+	pageSize := opts.PageSize
+	if pageSize <= 0 {
+		pageSize = DefaultPageSize
+	}
+	all = []EventTimeSeriesRS{}
+	// an incident can have several series, so the limit counts incident IDs
+	ids := map[string]bool{}
+	for offset := 0; ; offset += pageSize {
+		page, err := c.listActiveIncidentsV1Page(ctx, query, offset, pageSize)
+		if err != nil {
+			return []EventTimeSeriesRS{}, err
+		}
+		all = append(all, page...)
+		for _, series := range page {
+			ids[series.IncidentID] = true
+		}
+		if len(page) < pageSize || (opts.Limit > 0 && len(ids) >= opts.Limit) {
+			return all, nil
+		}
+	}
+}
+
+func (c *SFXClient) listActiveIncidentsV1Page(ctx context.Context, query string, offset, limit int) ([]EventTimeSeriesRS, error) {
+	req, err := c.newRequest(ctx, "GET", "v1/eventtimeseries", nil)
+	if err != nil {
+		return []EventTimeSeriesRS{}, err
+	}
+
+	// Add query params
+	q := req.URL.Query()
+	q.Add("query", `sf_organizationID:`+c.orgID+` AND (`+query+`)`)
+	q.Add("offset", strconv.Itoa(offset))
+	q.Add("limit", strconv.Itoa(limit))
+	q.Add("order_by", `-sf_priority,-sf_anomalyStateUpdateTimestampMs`)
+	req.URL.RawQuery = q.Encode()
+
+	s := new(EventTimeSeries)
+	if err := c.getConditionalJSON(req, &s); err != nil {
+		return []EventTimeSeriesRS{}, err
+	}
+	return s.RS, nil
+}
+
+// IncidentEvent (V2 API)
+type IncidentEvent struct {
+	Timestamp     int64  `json:"timestamp"`
+	AnomalyState  string `json:"anomalyState"`
+	IncidentID    string `json:"incidentId"`
+	DetectorID    string `json:"detectorId"`
+	DetectorName  string `json:"detectorName"`
+	EventSeverity string `json:"severity"`
+}
+
+// Incident (V2 API)
+type Incident struct {
+	IncidentID   string          `json:"incidentId"`
+	DetectorID   string          `json:"detectorId"`
+	DetectorName string          `json:"detectorName"`
+	AnomalyState string          `json:"anomalyState"`
+	Severity     string          `json:"severity"`
+	Active       bool            `json:"active"`
+	Events       []IncidentEvent `json:"events"`
+}
+
+// firstEventMs is when the incident first fired, the V2 analog of sf_createdOnMs
+func (i Incident) firstEventMs() int64 {
+	var first int64
+	for _, e := range i.Events {
+		if first == 0 || e.Timestamp < first {
+			first = e.Timestamp
+		}
+	}
+	return first
+}
+
+// lastEventMs is when the incident last changed, the V2 analog of sf_updatedOnMs
+func (i Incident) lastEventMs() int64 {
+	var last int64
+	for _, e := range i.Events {
+		if e.Timestamp > last {
+			last = e.Timestamp
+		}
+	}
+	return last
+}
+
+// listActiveIncidentsV2 pages through all active incidents from the v2 API,
+// opts.PageSize at a time. Incidents can move between pages while paging,
+// so the same incident may be returned more than once.
+func (c *SFXClient) listActiveIncidentsV2(ctx context.Context, opts ListOptions) ([]Incident, error) {
+	pageSize := opts.PageSize
+	if pageSize <= 0 {
+		pageSize = DefaultPageSize
+	}
+	all := []Incident{}
+	for offset := 0; ; offset += pageSize {
+		page, err := c.listActiveIncidentsV2Page(ctx, offset, pageSize)
+		if err != nil {
+			return []Incident{}, err
+		}
+		all = append(all, page...)
+		// Since is applied after listing, so with it set any page might be
+		// the one that reaches the limit
+		if len(page) < pageSize || (opts.Limit > 0 && opts.Since == 0 && len(all) >= opts.Limit) {
+			return all, nil
+		}
+	}
+}
+
+// https://developers.signalfx.com/incidents_reference.html#tag/Retrieve-Incidents
+func (c *SFXClient) listActiveIncidentsV2Page(ctx context.Context, offset, limit int) ([]Incident, error) {
+	req, err := c.newRequest(ctx, "GET", "v2/incident", nil)
+	if err != nil {
+		return []Incident{}, err
+	}
+
+	q := req.URL.Query()
+	q.Add("includeResolved", "false")
+	q.Add("offset", strconv.Itoa(offset))
+	q.Add("limit", strconv.Itoa(limit))
+	req.URL.RawQuery = q.Encode()
+
+	incidents := []Incident{}
+	if err := c.getConditionalJSON(req, &incidents); err != nil {
+		return []Incident{}, err
+	}
+	return incidents, nil
+}
+
+// ClearIncident works for V1 and V2 detectors. Clearing an incident that
+// isn't active returns an error wrapping ErrAlreadyCleared, so callers can
+// count it as done.
+// https://developers.signalfx.com/v2/reference#incidentidclear
+func (c *SFXClient) ClearIncident(ctx context.Context, incidentID string) (err error) {
+	ctx, span := c.startSpan(ctx, "clearIncident")
+	span.SetAttribute("incident.id", incidentID)
+	defer func() { span.End(err) }()
+
+	req, err := c.newRequest(ctx, "PUT", "v2/incident/"+incidentID+"/clear", nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := c.doWithRetry(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		err := newAPIError(resp)
+		if isAlreadyCleared(err) {
+			return fmt.Errorf("%w: %s", ErrAlreadyCleared, err)
+		}
+		return err
+	}
+
+	return nil
+}
+
+// msToTime converts a SignalFX epoch-milliseconds timestamp
+func msToTime(ms int64) time.Time {
+	return time.Unix(ms/1000, (ms%1000)*int64(time.Millisecond))
+}
@@ -0,0 +1,169 @@
+package janitor
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+// pagedHandler serves pages[n] as the body for the request at offset
+// n*pageSize, checking each asks for pageSize, and records the offsets requested
+func pagedHandler(t *testing.T, path string, pageSize int, pages []string, offsets *[]int) http.HandlerFunc {
+	var mu sync.Mutex
+	return func(w http.ResponseWriter, r *http.Request) {
+		checkRequest(t, r, "GET", path)
+		offset, _ := strconv.Atoi(r.URL.Query().Get("offset"))
+		if limit := r.URL.Query().Get("limit"); limit != strconv.Itoa(pageSize) {
+			t.Errorf("limit = %s, want %d", limit, pageSize)
+		}
+		mu.Lock()
+		*offsets = append(*offsets, offset)
+		mu.Unlock()
+		if offset%pageSize != 0 || offset/pageSize >= len(pages) {
+			t.Errorf("unexpected offset %d", offset)
+			http.Error(w, "no such page", http.StatusBadRequest)
+			return
+		}
+		w.Write([]byte(pages[offset/pageSize]))
+	}
+}
+
+func checkOffsets(t *testing.T, got []int, want ...int) {
+	t.Helper()
+	if len(got) != len(want) {
+		t.Fatalf("offsets requested = %v, want %v", got, want)
+	}
+	for n := range want {
+		if got[n] != want[n] {
+			t.Fatalf("offsets requested = %v, want %v", got, want)
+		}
+	}
+}
+
+func incidentIDs(incidents []SimpleIncident) []string {
+	ids := []string{}
+	for _, i := range incidents {
+		ids = append(ids, i.ID)
+	}
+	return ids
+}
+
+func checkIDs(t *testing.T, incidents []SimpleIncident, want ...string) {
+	t.Helper()
+	got := incidentIDs(incidents)
+	if len(got) != len(want) {
+		t.Fatalf("incidents = %v, want %v", got, want)
+	}
+	for n := range want {
+		if got[n] != want[n] {
+			t.Fatalf("incidents = %v, want %v", got, want)
+		}
+	}
+}
+
+func TestGetV1IncidentsPages(t *testing.T) {
+	var offsets []int
+	client, server := newTestClient(pagedHandler(t, "/v1/eventtimeseries", 2, []string{
+		`{"rs": [{"sf_incidentId": "i1", "sf_updatedOnMs": 1000}, {"sf_incidentId": "i2", "sf_updatedOnMs": 2000}]}`,
+		`{"rs": [{"sf_incidentId": "i3", "sf_updatedOnMs": 3000}]}`,
+	}, &offsets))
+	defer server.Close()
+
+	incidents, err := GetV1Incidents(context.Background(), client, ListOptions{PageSize: 2, Query: DefaultIncidentQuery})
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkOffsets(t, offsets, 0, 2)
+	checkIDs(t, incidents, "i1", "i2", "i3")
+}
+
+func TestGetIncidentsDefaultPageSize(t *testing.T) {
+	for _, tc := range []struct {
+		apiVersion, path, body string
+	}{
+		{apiVersion: "v1", path: "/v1/eventtimeseries", body: `{"rs": []}`},
+		{apiVersion: "v2", path: "/v2/incident", body: `[]`},
+	} {
+		t.Run(tc.apiVersion, func(t *testing.T) {
+			var offsets []int
+			client, server := newTestClient(pagedHandler(t, tc.path, DefaultPageSize, []string{tc.body}, &offsets))
+			defer server.Close()
+
+			incidents, err := GetIncidents(context.Background(), client, ListOptions{APIVersion: tc.apiVersion, Query: DefaultIncidentQuery})
+			if err != nil {
+				t.Fatal(err)
+			}
+			checkOffsets(t, offsets, 0)
+			checkIDs(t, incidents)
+		})
+	}
+}
+
+func TestGetV1IncidentsDuplicateSeries(t *testing.T) {
+	var offsets []int
+	client, server := newTestClient(pagedHandler(t, "/v1/eventtimeseries", 10, []string{`{"rs": [
+		{"sf_incidentId": "i1", "sf_detectorId": "D1", "sf_updatedOnMs": 1000},
+		{"sf_incidentId": "i2", "sf_detectorId": "D2", "sf_updatedOnMs": 2000},
+		{"sf_incidentId": "i1", "sf_detectorId": "D1", "sf_updatedOnMs": 5000},
+		{"sf_incidentId": "i1", "sf_detectorId": "D1", "sf_updatedOnMs": 3000}
+	]}`}, &offsets))
+	defer server.Close()
+
+	incidents, err := GetV1Incidents(context.Background(), client, ListOptions{PageSize: 10, Query: DefaultIncidentQuery})
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkIDs(t, incidents, "i1", "i2")
+	if got := incidents[0].UpdatedAt.Unix(); got != 5 {
+		t.Errorf("i1 UpdatedAt = %d, want its latest series' 5", got)
+	}
+}
+
+func TestGetV2IncidentsPages(t *testing.T) {
+	var offsets []int
+	client, server := newTestClient(pagedHandler(t, "/v2/incident", 2, []string{
+		`[{"incidentId": "i1", "events": [{"timestamp": 1000}]}, {"incidentId": "i2", "events": [{"timestamp": 2000}]}]`,
+		`[{"incidentId": "i2", "events": [{"timestamp": 2000}]}, {"incidentId": "i3", "events": [{"timestamp": 3000}]}]`,
+		`[]`,
+	}, &offsets))
+	defer server.Close()
+
+	incidents, err := GetV2Incidents(context.Background(), client, ListOptions{PageSize: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkOffsets(t, offsets, 0, 2, 4)
+	checkIDs(t, incidents, "i1", "i2", "i3")
+}
+
+func TestGetV1IncidentsDefaultQuery(t *testing.T) {
+	client, server := newTestClient(func(w http.ResponseWriter, r *http.Request) {
+		if want := "sf_organizationID:" + testOrgID + " AND (" + DefaultIncidentQuery + ")"; r.URL.Query().Get("query") != want {
+			t.Errorf("query = %q, want %q", r.URL.Query().Get("query"), want)
+		}
+		w.Write([]byte(`{"rs": []}`))
+	})
+	defer server.Close()
+
+	if _, err := GetV1Incidents(context.Background(), client, ListOptions{}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestGetV1IncidentsLimitCountsIncidents(t *testing.T) {
+	var offsets []int
+	client, server := newTestClient(pagedHandler(t, "/v1/eventtimeseries", 2, []string{
+		`{"rs": [{"sf_incidentId": "i1", "sf_updatedOnMs": 1000}, {"sf_incidentId": "i1", "sf_updatedOnMs": 2000}]}`,
+		`{"rs": [{"sf_incidentId": "i2", "sf_updatedOnMs": 3000}, {"sf_incidentId": "i3", "sf_updatedOnMs": 4000}]}`,
+	}, &offsets))
+	defer server.Close()
+
+	incidents, err := GetV1Incidents(context.Background(), client, ListOptions{PageSize: 2, Limit: 2, Query: DefaultIncidentQuery})
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkOffsets(t, offsets, 0, 2)
+	checkIDs(t, incidents, "i1", "i2")
+}
@@ -0,0 +1,69 @@
+package janitor
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"strings"
+)
+
+// Logger writes leveled log lines
+type Logger interface {
+	Debugf(format string, args ...interface{})
+	Infof(format string, args ...interface{})
+	Warnf(format string, args ...interface{})
+	Errorf(format string, args ...interface{})
+}
+
+// LogLevel is the minimum severity a Logger writes
+type LogLevel int
+
+// Log levels in increasing order of severity
+const (
+	LevelDebug LogLevel = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+var logLevelNames = []string{"debug", "info", "warn", "error"}
+
+func (l LogLevel) String() string {
+	if l < 0 || int(l) >= len(logLevelNames) {
+		return fmt.Sprintf("LogLevel(%d)", int(l))
+	}
+	return logLevelNames[l]
+}
+
+// ParseLogLevel parses a level name, case-insensitively
+func ParseLogLevel(name string) (LogLevel, error) {
+	for i, n := range logLevelNames {
+		if strings.EqualFold(n, name) {
+			return LogLevel(i), nil
+		}
+	}
+	return LevelInfo, fmt.Errorf("unknown log level %q", name)
+}
+
+type levelLogger struct {
+	level LogLevel
+	out   *log.Logger
+}
+
+// NewLogger returns a Logger that writes lines at or above level to w,
+// in the standard log format with the level as a prefix
+func NewLogger(w io.Writer, level LogLevel) Logger {
+	return &levelLogger{level: level, out: log.New(w, "", log.LstdFlags)}
+}
+
+func (l *levelLogger) logf(level LogLevel, format string, args []interface{}) {
+	if level < l.level {
+		return
+	}
+	l.out.Printf(strings.ToUpper(level.String())+" "+format, args...)
+}
+
+func (l *levelLogger) Debugf(format string, args ...interface{}) { l.logf(LevelDebug, format, args) }
+func (l *levelLogger) Infof(format string, args ...interface{})  { l.logf(LevelInfo, format, args) }
+func (l *levelLogger) Warnf(format string, args ...interface{})  { l.logf(LevelWarn, format, args) }
+func (l *levelLogger) Errorf(format string, args ...interface{}) { l.logf(LevelError, format, args) }
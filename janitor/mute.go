@@ -0,0 +1,360 @@
+package janitor
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// MuteOptions controls the mutings MuteDetectors creates
+type MuteOptions struct {
+	// Filters, if any, narrow every muting beyond its detector
+	Filters []AlertMutingFilter
+	// Start and Stop bound when the mutings are in effect
+	Start time.Time
+	Stop  time.Time
+	// Description is appended to each muting's description, or fills {info}
+	// in DescriptionTemplate
+	Description string
+	// DescriptionTemplate, if set, replaces the default description, see MutingDescription
+	DescriptionTemplate string
+	// Force creates a new muting even if an existing one already covers it
+	Force bool
+	// MaxDuration, if positive, rejects mutings longer than it
+	MaxDuration time.Duration
+}
+
+// DefaultMaxMuteDuration is the longest mute MuteDetector allows, so a typo
+// can't silence a detector for a year
+const DefaultMaxMuteDuration = 72 * time.Hour
+
+// CheckMuteDuration rejects non-positive durations, and durations over max
+// unless max is zero
+func CheckMuteDuration(d, max time.Duration) error {
+	if d <= 0 {
+		return fmt.Errorf("mute duration must be positive, got %s", d)
+	}
+	if max > 0 && d > max {
+		return fmt.Errorf("mute duration %s is longer than the maximum of %s", d, max)
+	}
+	return nil
+}
+
+// MuteDetector mutes a V1 or V2 detector for silence, starting now, unless
+// it's already muted for that long. silence may not exceed DefaultMaxMuteDuration.
+func MuteDetector(ctx context.Context, client *SFXClient, detectorID string, silence time.Duration, info string) error {
+	existing, err := client.ListAlertMutings(ctx, detectorID)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	return muteDetector(ctx, client, detectorID, MuteOptions{
+		Start:       now,
+		Stop:        now.Add(silence),
+		Description: info,
+		MaxDuration: DefaultMaxMuteDuration,
+	}, existing)
+}
+
+// muteDetector creates a muting for detectorID, unless opts.Force is false
+// and one of existing, as listed by ListAlertMutings, already covers it
+func muteDetector(ctx context.Context, client *SFXClient, detectorID string, opts MuteOptions, existing []AlertMuting) (err error) {
+	ctx, span := client.startSpan(ctx, "muteDetector")
+	span.SetAttribute("detector.id", detectorID)
+	defer func() { span.End(err) }()
+
+	if err := CheckMuteDuration(opts.Stop.Sub(opts.Start), opts.MaxDuration); err != nil {
+		return err
+	}
+	filters := append([]AlertMutingFilter{DetectorFilter(detectorID)}, opts.Filters...)
+	if !opts.Force {
+		for _, m := range existing {
+			if m.MutesDetector(detectorID) && m.Covers(filters, opts.Start, opts.Stop) {
+				client.logger.Infof("Detector %s already muted until %s by %s", detectorID, m.Stop().In(opts.Start.Location()).Format(time.RFC3339), m.ID)
+				return nil
+			}
+		}
+	}
+
+	description := MutingDescription(opts.DescriptionTemplate, opts.Description, detectorID, opts.Start, opts.Stop)
+	if err := client.CreateMuting(ctx, filters, opts.Start, opts.Stop, description); err != nil {
+		return err
+	}
+	client.logger.Infof("Muted detector %s from %s until %s", detectorID, opts.Start.Format(time.RFC3339), opts.Stop.Format(time.RFC3339))
+	return nil
+}
+
+// MuteDetectors mutes each detector separately, so one failure doesn't stop
+// the rest from being muted. Detectors an existing muting already covers are
+// left alone unless opts.Force is set. It returns the detectors that were
+// muted (or already were), and all failures together as a MultiError.
+func MuteDetectors(ctx context.Context, client *SFXClient, detectorIDs []string, opts MuteOptions) ([]string, error) {
+	muted := []string{}
+	var existing []AlertMuting
+	if !opts.Force {
+		var err error
+		existing, err = client.ListAlertMutings(ctx, "")
+		if err != nil {
+			return muted, fmt.Errorf("error looking up mutings: %w", err)
+		}
+	}
+	errs := MultiError{}
+	for _, id := range detectorIDs {
+		if ctx.Err() != nil {
+			client.logger.Warnf("cancelled after muting %d of %d detectors", len(muted), len(detectorIDs))
+			errs = append(errs, ctx.Err())
+			break
+		}
+		if err := muteDetector(ctx, client, id, opts, existing); err != nil {
+			client.logger.Errorf("error muting detector %s: %s", id, err)
+			errs = append(errs, fmt.Errorf("error muting detector %s: %w", id, err))
+			continue
+		}
+		muted = append(muted, id)
+	}
+
+	client.logger.Infof("Muted %d of %d detectors", len(muted), len(detectorIDs))
+	if len(errs) > 0 {
+		return muted, errs
+	}
+	return muted, nil
+}
+
+// DetectorFilter matches everything from a single detector
+func DetectorFilter(detectorID string) AlertMutingFilter {
+	return AlertMutingFilter{Property: "sf_detectorId", PropertyValue: detectorID}
+}
+
+// MutingDescription renders a muting description. With no template it's
+// "Muted by signalfx-janitor", plus ": info" if info is set. Otherwise the
+// template's {detector}, {duration}, {user}, {now}, and {info} placeholders
+// are filled in, with {now} in start's location.
+func MutingDescription(template, info, detector string, start, stop time.Time) string {
+	if template == "" {
+		if info == "" {
+			return "Muted by signalfx-janitor"
+		}
+		return "Muted by signalfx-janitor: " + info
+	}
+	return strings.NewReplacer(
+		"{detector}", detector,
+		"{duration}", stop.Sub(start).String(),
+		"{user}", currentUser(),
+		"{now}", time.Now().In(start.Location()).Format(time.RFC3339),
+		"{info}", info,
+	).Replace(template)
+}
+
+// currentUser names whoever is running the janitor, for {user}
+func currentUser() string {
+	if name := os.Getenv("USER"); name != "" {
+		return name
+	}
+	if u, err := user.Current(); err == nil {
+		return u.Username
+	}
+	return "unknown"
+}
+
+// CreateMuting mutes alerts matching all filters between start and stop
+// https://developers.signalfx.com/reference#alertmuting-1
+func (c *SFXClient) CreateMuting(ctx context.Context, filters []AlertMutingFilter, start, stop time.Time, description string) error {
+	round := int64(time.Millisecond) / int64(time.Nanosecond)
+	args := map[string]interface{}{
+		"filters":     filters,
+		"startTime":   start.UnixNano() / round,
+		"stopTime":    stop.UnixNano() / round,
+		"description": description,
+	}
+
+	data, _ := json.Marshal(args)
+
+	req, err := c.newRequest(ctx, "POST", "v2/alertmuting", bytes.NewBuffer(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := c.doWithRetry(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 201 {
+		return newAPIError(resp)
+	}
+
+	return nil
+}
+
+// AlertMutingFilter (V2 API)
+type AlertMutingFilter struct {
+	Property      string `json:"property"`
+	PropertyValue string `json:"propertyValue"`
+	NOT           bool   `json:"NOT"`
+}
+
+// AlertMuting (V2 API)
+type AlertMuting struct {
+	ID          string              `json:"id"`
+	Description string              `json:"description"`
+	Filters     []AlertMutingFilter `json:"filters"`
+	StartTime   int64               `json:"startTime"`
+	StopTime    int64               `json:"stopTime"`
+}
+
+// AlertMutings (V2 API)
+type AlertMutings struct {
+	Count   int           `json:"count"`
+	Results []AlertMuting `json:"results"`
+}
+
+// Start is when the muting takes effect
+func (m AlertMuting) Start() time.Time {
+	return msToTime(m.StartTime)
+}
+
+// Stop is when the muting expires
+func (m AlertMuting) Stop() time.Time {
+	return msToTime(m.StopTime)
+}
+
+// MutesDetector reports whether the muting has an sf_detectorId filter for detectorID
+func (m AlertMuting) MutesDetector(detectorID string) bool {
+	for _, f := range m.Filters {
+		if f.Property == "sf_detectorId" && f.PropertyValue == detectorID && !f.NOT {
+			return true
+		}
+	}
+	return false
+}
+
+// FillMuted sets Muted on each incident whose detector a muting in effect at
+// now mutes
+func FillMuted(ctx context.Context, client *SFXClient, incidents []SimpleIncident, now time.Time) error {
+	mutings, err := client.ListAlertMutings(ctx, "")
+	if err != nil {
+		return err
+	}
+	active := []AlertMuting{}
+	for _, m := range mutings {
+		if !m.Start().After(now) && m.Stop().After(now) {
+			active = append(active, m)
+		}
+	}
+	for n, i := range incidents {
+		for _, m := range active {
+			if m.MutesDetector(i.DetectorID) {
+				incidents[n].Muted = true
+				break
+			}
+		}
+	}
+	return nil
+}
+
+// Covers reports whether the muting already mutes everything a new muting
+// with filters would between start and stop: it must be in effect for that
+// whole window, and each of its filters must be one of filters (a muting with
+// fewer filters mutes more).
+func (m AlertMuting) Covers(filters []AlertMutingFilter, start, stop time.Time) bool {
+	if m.Start().After(start) || m.Stop().Before(stop) {
+		return false
+	}
+	for _, have := range m.Filters {
+		found := false
+		for _, want := range filters {
+			if have == want {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// mutingsPageSize is the number of mutings requested per page
+const mutingsPageSize = 100
+
+// ListAlertMutings gets active and scheduled mutings, restricted to those
+// muting detectorID unless it is empty. That restriction is queried
+// server-side, and checked again with MutesDetector.
+// https://developers.signalfx.com/reference#retrieve-alert-muting-rules-query
+func (c *SFXClient) ListAlertMutings(ctx context.Context, detectorID string) ([]AlertMuting, error) {
+	mutings := []AlertMuting{}
+	for offset := 0; ; offset += mutingsPageSize {
+		req, err := c.newRequest(ctx, "GET", "v2/alertmuting", nil)
+		if err != nil {
+			return []AlertMuting{}, err
+		}
+		q := req.URL.Query()
+		q.Add("include", "Open")
+		if detectorID != "" {
+			q.Add("query", "sf_detectorId:"+detectorID)
+		}
+		q.Add("offset", strconv.Itoa(offset))
+		q.Add("limit", strconv.Itoa(mutingsPageSize))
+		req.URL.RawQuery = q.Encode()
+
+		resp, err := c.doWithRetry(req)
+		if err != nil {
+			return []AlertMuting{}, err
+		}
+		if resp.StatusCode != 200 {
+			err = newAPIError(resp)
+			resp.Body.Close()
+			return []AlertMuting{}, err
+		}
+		body, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return []AlertMuting{}, err
+		}
+
+		page := new(AlertMutings)
+		err = json.Unmarshal(body, &page)
+		if err != nil {
+			return []AlertMuting{}, newDecodeError(resp, body, err)
+		}
+		for _, m := range page.Results {
+			if detectorID == "" || m.MutesDetector(detectorID) {
+				mutings = append(mutings, m)
+			}
+		}
+		if len(page.Results) < mutingsPageSize {
+			return mutings, nil
+		}
+	}
+}
+
+// DeleteAlertMuting removes a muting, unmuting whatever it covered
+// https://developers.signalfx.com/reference#delete-alert-muting-rule
+func (c *SFXClient) DeleteAlertMuting(ctx context.Context, mutingID string) error {
+	req, err := c.newRequest(ctx, "DELETE", "v2/alertmuting/"+mutingID, nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := c.doWithRetry(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 && resp.StatusCode != 204 {
+		return newAPIError(resp)
+	}
+
+	return nil
+}
@@ -0,0 +1,25 @@
+package janitor
+
+import (
+	"context"
+)
+
+// Realms are the SignalFX realms DetectRealm tries, in order. DefaultBaseURL
+// is us0.
+var Realms = []string{"us0", "us1", "us2", "eu0", "jp0", "au0"}
+
+// DetectRealm finds the realm whose API accepts cfg's token, by asking each
+// of Realms for the token's org. cfg.BaseURL is ignored, and requests aren't
+// retried or reported to cfg.OnAPIError. It returns "" if no realm accepts
+// the token.
+func DetectRealm(ctx context.Context, cfg SFXClientConfig) string {
+	cfg.MaxRetries = 0
+	cfg.OnAPIError = nil
+	for _, realm := range Realms {
+		cfg.BaseURL = APIBaseURL(realm, "")
+		if err := NewSFXClient(cfg).Ping(ctx); err == nil {
+			return realm
+		}
+	}
+	return ""
+}
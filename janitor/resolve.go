@@ -0,0 +1,368 @@
+package janitor
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultStaleAfter is how long an incident must be inactive before it's
+// cleared unless ResolveOptions.StaleAfter says otherwise
+const DefaultStaleAfter = 30 * time.Minute
+
+// ResolveOptions controls which incidents ResolveIncidents clears
+type ResolveOptions struct {
+	// StaleAfter is how long an incident must be inactive before it is
+	// cleared. Defaults to DefaultStaleAfter.
+	StaleAfter time.Duration
+	// Rules override StaleAfter for the detectors they match. The first
+	// matching rule wins.
+	Rules []StaleRule
+	// DurationMultiplier, if positive, makes incidents stale after their
+	// detector's DetectorDuration times this, for detectors without a
+	// matching rule. Unknown durations fall back to StaleAfter.
+	DurationMultiplier float64
+	// AnyAge clears incidents regardless of StaleAfter and Rules
+	AnyAge bool
+	// IncludeMuted clears incidents whose detectors are muted too. Otherwise
+	// they're left alone, if FillMuted has marked them.
+	IncludeMuted bool
+	// RequireMuted only clears incidents whose detectors are muted (as
+	// marked by FillMuted), which won't page anyone if they refire
+	RequireMuted bool
+	// MinAge, if positive, protects incidents that first fired more recently
+	// than that from being cleared, even with AnyAge
+	MinAge time.Duration
+	// RecentUpdate, if positive, protects incidents that updated more
+	// recently than that from being cleared, even with AnyAge or a short
+	// rule: they're still live
+	RecentUpdate time.Duration
+	// DetectorID, if set, limits clearing to that detector's incidents
+	DetectorID string
+	// DetectorType, if set, limits clearing to incidents of that type of
+	// detector, DetectorTypeV1 or DetectorTypeV2. The incidents' types must
+	// have been filled in with FillDetectorTypes.
+	DetectorType string
+	// DryRun logs what would be cleared without clearing anything
+	DryRun bool
+	// Concurrency is how many incidents are cleared in parallel
+	Concurrency int
+	// DetectorFilter, if set, limits clearing to incidents whose label matches
+	DetectorFilter *regexp.Regexp
+	// ExcludeDetector, if set, protects incidents whose label matches from ever being cleared
+	ExcludeDetector *regexp.Regexp
+	// MinSeverity and MaxSeverity, unless SeverityUnknown, bound the
+	// severities that are cleared. Incidents of unknown severity are never
+	// cleared when either bound is set.
+	MinSeverity Severity
+	MaxSeverity Severity
+	// Priorities, if any, limit clearing to incidents with one of these
+	// priorities. Incidents of unknown priority are never cleared then.
+	Priorities []int
+	// MaxResolve, if positive, caps how many incidents are cleared (or, in a
+	// dry run, would be). The rest are counted in ResolveStats.Capped.
+	MaxResolve int
+	// MuteOnResolve, if positive, mutes the detector of every incident that
+	// was cleared for that long, so it doesn't immediately refire
+	MuteOnResolve time.Duration
+	// MaxMuteDuration, if positive, rejects a MuteOnResolve longer than it,
+	// e.g. DefaultMaxMuteDuration. Zero allows any length.
+	MaxMuteDuration time.Duration
+	// OnResolved, if set, is called as soon as each incident is cleared
+	// (not in a dry run). Calls are never concurrent.
+	OnResolved func(SimpleIncident)
+}
+
+// skipReason explains why an incident shouldn't be cleared, or returns "" if it should
+func (opts ResolveOptions) skipReason(i SimpleIncident, now time.Time) string {
+	if opts.ExcludeDetector != nil && opts.ExcludeDetector.MatchString(i.Label()) {
+		return "excluded detector"
+	}
+	if opts.DetectorID != "" && i.DetectorID != opts.DetectorID {
+		return "from another detector"
+	}
+	if i.Muted && !opts.IncludeMuted && !opts.RequireMuted {
+		return "detector is muted"
+	}
+	if !i.Muted && opts.RequireMuted {
+		return "detector isn't muted"
+	}
+	if opts.DetectorType != "" && i.DetectorType != opts.DetectorType {
+		return fmt.Sprintf("detector type %q isn't %s", i.DetectorType, opts.DetectorType)
+	}
+	if opts.DetectorFilter != nil && !opts.DetectorFilter.MatchString(i.Label()) {
+		return "detector doesn't match detector-filter"
+	}
+	if (opts.MinSeverity != SeverityUnknown || opts.MaxSeverity != SeverityUnknown) && i.Severity == SeverityUnknown {
+		return "unknown severity"
+	}
+	if opts.MinSeverity != SeverityUnknown && i.Severity < opts.MinSeverity {
+		return fmt.Sprintf("severity %s is below min-severity", i.Severity)
+	}
+	if opts.MaxSeverity != SeverityUnknown && i.Severity > opts.MaxSeverity {
+		return fmt.Sprintf("severity %s is above max-severity", i.Severity)
+	}
+	if opts.MinAge > 0 && now.Sub(i.CreatedAt) < opts.MinAge {
+		return "younger than min-age"
+	}
+	if opts.RecentUpdate > 0 && now.Sub(i.UpdatedAt) < opts.RecentUpdate {
+		return "updated too recently"
+	}
+	if len(opts.Priorities) > 0 && !containsPriority(opts.Priorities, i.Priority) {
+		return fmt.Sprintf("priority %d isn't one of priority", i.Priority)
+	}
+	if !opts.AnyAge && !i.UpdatedAt.Before(now.Add(-opts.staleAfter(i))) {
+		return "not stale"
+	}
+	return ""
+}
+
+func containsPriority(priorities []int, priority int) bool {
+	for _, p := range priorities {
+		if p == priority {
+			return true
+		}
+	}
+	return false
+}
+
+// StaleRule is a stale-after threshold for detectors whose name matches
+// Detector, a glob pattern like "batch-*". Its * matches any run of
+// characters, including "/"; everything else matches itself.
+type StaleRule struct {
+	Detector   string
+	StaleAfter time.Duration
+}
+
+// matches reports whether the detector name matches r's pattern
+func (r StaleRule) matches(name string) bool {
+	pattern := strings.Replace(regexp.QuoteMeta(r.Detector), `\*`, ".*", -1)
+	return regexp.MustCompile("^" + pattern + "$").MatchString(name)
+}
+
+// staleAfter is the threshold of the first rule matching i's detector, or a
+// multiple of the detector's duration, or opts.StaleAfter
+func (opts ResolveOptions) staleAfter(i SimpleIncident) time.Duration {
+	for _, r := range opts.Rules {
+		if r.matches(i.DetectorName) {
+			return r.StaleAfter
+		}
+	}
+	if opts.DurationMultiplier > 0 && i.DetectorDuration > 0 {
+		return time.Duration(float64(i.DetectorDuration) * opts.DurationMultiplier)
+	}
+	if opts.StaleAfter <= 0 {
+		return DefaultStaleAfter
+	}
+	return opts.StaleAfter
+}
+
+// StaleIncidents returns the incidents ResolveIncidents would clear, without
+// clearing anything
+func (opts ResolveOptions) StaleIncidents(incidents []SimpleIncident, now time.Time) []SimpleIncident {
+	stale := []SimpleIncident{}
+	for _, i := range incidents {
+		if opts.skipReason(i, now) == "" {
+			stale = append(stale, i)
+		}
+	}
+	return stale
+}
+
+// ResolveStats counts what ResolveIncidents did
+type ResolveStats struct {
+	Found int
+	// Resolved incidents were cleared, or would have been in a dry run
+	Resolved int
+	// Skipped incidents were left alone, e.g. because they weren't stale
+	Skipped int
+	// AlreadyResolved incidents were cleared by someone else before we got to them
+	AlreadyResolved int
+	// Failed incidents could not be cleared
+	Failed int
+	// Capped incidents were stale, but left alone because of MaxResolve
+	Capped int
+	// ResolvedIncidents are the incidents counted in Resolved
+	ResolvedIncidents []SimpleIncident
+	// MutedDetectors are the detectors muted because of MuteOnResolve
+	MutedDetectors []string
+	// Outcomes are what happened to each incident, by incident ID
+	Outcomes map[string]Outcome
+}
+
+// Outcome is what ResolveIncidents did with an incident
+type Outcome string
+
+// The outcomes counted by ResolveStats
+const (
+	OutcomeResolved        Outcome = "resolved"
+	OutcomeSkipped         Outcome = "skipped"
+	OutcomeAlreadyResolved Outcome = "already resolved"
+	OutcomeFailed          Outcome = "failed"
+	OutcomeCapped          Outcome = "capped"
+)
+
+// ResolveIncidents clears stale incidents, opts.Concurrency at a time. A
+// failure to clear one incident doesn't stop the rest from being processed;
+// all failures are returned together as a MultiError. Cancelling ctx stops
+// it between incidents, reporting ctx's error alongside any failures.
+func ResolveIncidents(ctx context.Context, client *SFXClient, incidents []SimpleIncident, opts ResolveOptions) (ResolveStats, error) {
+	stats := ResolveStats{Found: len(incidents), Outcomes: map[string]Outcome{}}
+	stale := []SimpleIncident{}
+	now := time.Now()
+	for _, i := range incidents {
+		client.logger.Debugf("Incident: %s", i)
+		if reason := opts.skipReason(i, now); reason != "" {
+			client.logger.Debugf("Skipping %s: %s", i.ID, reason)
+			stats.Skipped++
+			stats.Outcomes[i.ID] = OutcomeSkipped
+		} else if opts.MaxResolve > 0 && stats.Resolved+len(stale) >= opts.MaxResolve {
+			client.logger.Debugf("Skipping %s: max-resolve reached", i.ID)
+			stats.Capped++
+			stats.Outcomes[i.ID] = OutcomeCapped
+		} else if opts.DryRun {
+			client.logger.Infof("dry-run: would clear incident %s: %s", i.ID, i)
+			stats.Resolved++
+			stats.Outcomes[i.ID] = OutcomeResolved
+			stats.ResolvedIncidents = append(stats.ResolvedIncidents, i)
+		} else {
+			stale = append(stale, i)
+		}
+	}
+
+	errs := clearIncidents(ctx, client, stale, opts.Concurrency, opts.OnResolved, &stats)
+
+	if opts.MuteOnResolve > 0 {
+		errs = append(errs, muteResolvedDetectors(ctx, client, opts, &stats)...)
+	}
+
+	if stats.Capped > 0 {
+		client.logger.Warnf("max-resolve %d reached, left %d stale incidents alone", opts.MaxResolve, stats.Capped)
+	}
+
+	if opts.DryRun {
+		client.logger.Infof("dry-run: would have resolved %d of %d incidents", stats.Resolved, stats.Found)
+	} else {
+		client.logger.Infof("Resolved %d of %d incidents (%d already resolved, %d failed)",
+			stats.Resolved, stats.Found, stats.AlreadyResolved, stats.Failed)
+	}
+	if len(errs) > 0 {
+		return stats, errs
+	}
+	return stats, nil
+}
+
+// muteResolvedDetectors mutes, once each, the detectors of the incidents
+// counted in stats.ResolvedIncidents for opts.MuteOnResolve
+func muteResolvedDetectors(ctx context.Context, client *SFXClient, opts ResolveOptions, stats *ResolveStats) MultiError {
+	if len(stats.ResolvedIncidents) == 0 {
+		return nil
+	}
+	if err := CheckMuteDuration(opts.MuteOnResolve, opts.MaxMuteDuration); err != nil {
+		return MultiError{err}
+	}
+	// one listing covers every detector, instead of one per detector
+	var existing []AlertMuting
+	if !opts.DryRun {
+		var err error
+		existing, err = client.ListAlertMutings(ctx, "")
+		if err != nil {
+			return MultiError{fmt.Errorf("error looking up mutings: %w", err)}
+		}
+	}
+
+	errs := MultiError{}
+	seen := map[string]bool{}
+	for _, i := range stats.ResolvedIncidents {
+		if i.DetectorID == "" || seen[i.DetectorID] {
+			continue
+		}
+		seen[i.DetectorID] = true
+
+		if opts.DryRun {
+			client.logger.Infof("dry-run: would mute detector %s for %s", i.Label(), opts.MuteOnResolve)
+			continue
+		}
+		now := time.Now()
+		err := muteDetector(ctx, client, i.DetectorID, MuteOptions{
+			Start:       now,
+			Stop:        now.Add(opts.MuteOnResolve),
+			Description: "after resolving incident " + i.ID,
+			MaxDuration: opts.MaxMuteDuration,
+		}, existing)
+		if err != nil {
+			client.logger.Errorf("error muting detector %s: %s", i.DetectorID, err)
+			errs = append(errs, fmt.Errorf("error muting detector %s: %w", i.DetectorID, err))
+			continue
+		}
+		stats.MutedDetectors = append(stats.MutedDetectors, i.DetectorID)
+	}
+	return errs
+}
+
+// clearIncidents clears incidents using a pool of concurrency workers,
+// tallying outcomes into stats. The incident API has no bulk clear, only
+// PUT v2/incident/{id}/clear, so concurrency (within the client's rate
+// limit) is the only way to speed this up.
+func clearIncidents(ctx context.Context, client *SFXClient, incidents []SimpleIncident, concurrency int, onResolved func(SimpleIncident), stats *ResolveStats) MultiError {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	errs := MultiError{}
+	jobs := make(chan SimpleIncident)
+	for w := 0; w < concurrency; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				err := client.ClearIncident(ctx, i.ID)
+
+				mu.Lock()
+				if errors.Is(err, ErrAlreadyCleared) {
+					client.logger.Debugf("Incident already resolved: %s", i.ID)
+					stats.AlreadyResolved++
+					stats.Outcomes[i.ID] = OutcomeAlreadyResolved
+				} else if err != nil {
+					client.logger.Errorf("error resolving incident %s: %s", i.ID, err)
+					errs = append(errs, fmt.Errorf("error resolving incident %s: %w", i.ID, err))
+					stats.Failed++
+					stats.Outcomes[i.ID] = OutcomeFailed
+				} else {
+					client.logger.Debugf("Resolved incident: %s", i.ID)
+					stats.Resolved++
+					stats.Outcomes[i.ID] = OutcomeResolved
+					stats.ResolvedIncidents = append(stats.ResolvedIncidents, i)
+					if onResolved != nil {
+						onResolved(i)
+					}
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+
+	sent := 0
+	for _, i := range incidents {
+		if ctx.Err() != nil {
+			break
+		}
+		jobs <- i
+		sent++
+	}
+	close(jobs)
+	wg.Wait()
+
+	if err := ctx.Err(); err != nil {
+		client.logger.Warnf("cancelled after %d of %d incidents", sent, len(incidents))
+		errs = append(errs, err)
+	}
+
+	return errs
+}
@@ -0,0 +1,140 @@
+package janitor
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestResolveIncidentsClearsEachOnce(t *testing.T) {
+	var mu sync.Mutex
+	clears := map[string]int{}
+	client, server := newTestClient(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "PUT" || !strings.HasPrefix(r.URL.Path, "/v2/incident/") || !strings.HasSuffix(r.URL.Path, "/clear") {
+			t.Errorf("unexpected request %s %s", r.Method, r.URL.Path)
+			return
+		}
+		id := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/v2/incident/"), "/clear")
+		mu.Lock()
+		clears[id]++
+		mu.Unlock()
+	})
+	defer server.Close()
+
+	incidents := []SimpleIncident{}
+	old := time.Now().Add(-time.Hour)
+	for n := 0; n < 23; n++ {
+		incidents = append(incidents, SimpleIncident{ID: fmt.Sprintf("i%d", n), DetectorID: "D1", CreatedAt: old, UpdatedAt: old})
+	}
+
+	stats, err := ResolveIncidents(context.Background(), client, incidents, ResolveOptions{StaleAfter: time.Minute, Concurrency: 5})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Resolved != len(incidents) {
+		t.Errorf("Resolved = %d, want %d", stats.Resolved, len(incidents))
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(clears) != len(incidents) {
+		t.Errorf("cleared %d incidents, want %d", len(clears), len(incidents))
+	}
+	for _, i := range incidents {
+		if clears[i.ID] != 1 {
+			t.Errorf("incident %s cleared %d times, want 1", i.ID, clears[i.ID])
+		}
+	}
+}
+
+func TestStaleRuleMatches(t *testing.T) {
+	for _, tc := range []struct {
+		pattern, name string
+		want          bool
+	}{
+		{pattern: "batch-*", name: "batch-nightly", want: true},
+		{pattern: "batch-*", name: "batch-nightly / orders", want: true},
+		{pattern: "* / orders", name: "batch-nightly / orders", want: true},
+		{pattern: "batch-*", name: "nightly batch-orders", want: false},
+		{pattern: "cpu [prod]", name: "cpu [prod]", want: true},
+		{pattern: "cpu [prod]", name: "cpu p", want: false},
+		{pattern: "a.b", name: "axb", want: false},
+	} {
+		if got := (StaleRule{Detector: tc.pattern}).matches(tc.name); got != tc.want {
+			t.Errorf("%q matches %q = %v, want %v", tc.pattern, tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestResolveIncidentsDefaultStaleAfter(t *testing.T) {
+	var cleared []string
+	client, server := newTestClient(func(w http.ResponseWriter, r *http.Request) {
+		cleared = append(cleared, strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/v2/incident/"), "/clear"))
+	})
+	defer server.Close()
+
+	now := time.Now()
+	incidents := []SimpleIncident{
+		{ID: "fresh", CreatedAt: now.Add(-time.Second), UpdatedAt: now.Add(-time.Second)},
+		{ID: "stale", CreatedAt: now.Add(-2 * DefaultStaleAfter), UpdatedAt: now.Add(-2 * DefaultStaleAfter)},
+	}
+	stats, err := ResolveIncidents(context.Background(), client, incidents, ResolveOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Resolved != 1 || len(cleared) != 1 || cleared[0] != "stale" {
+		t.Errorf("cleared %v, want only the stale incident", cleared)
+	}
+}
+
+func TestResolveIncidentsMuteOnResolve(t *testing.T) {
+	var mu sync.Mutex
+	listings := 0
+	var mutings []mutingRequest
+	client, server := newTestClient(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		switch {
+		case r.Method == "GET" && r.URL.Path == "/v2/alertmuting":
+			listings++
+			w.Write([]byte(`{"count": 1, "results": [
+				{"id": "m1", "filters": [{"property": "sf_detectorId", "propertyValue": "D2"}], "startTime": 1, "stopTime": 99999999999999}
+			]}`))
+		case r.Method == "POST" && r.URL.Path == "/v2/alertmuting":
+			mutingHandler(t, http.StatusCreated, &mutings)(w, r)
+		case r.Method == "PUT":
+		default:
+			t.Errorf("unexpected request %s %s", r.Method, r.URL.Path)
+		}
+	})
+	defer server.Close()
+
+	old := time.Now().Add(-time.Hour)
+	incidents := []SimpleIncident{
+		{ID: "i1", DetectorID: "D1", CreatedAt: old, UpdatedAt: old},
+		{ID: "i2", DetectorID: "D1", CreatedAt: old, UpdatedAt: old},
+		{ID: "i3", DetectorID: "D2", CreatedAt: old, UpdatedAt: old},
+	}
+	opts := ResolveOptions{StaleAfter: time.Minute, MuteOnResolve: time.Hour, MaxMuteDuration: DefaultMaxMuteDuration}
+	stats, err := ResolveIncidents(context.Background(), client, incidents, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if listings != 1 {
+		t.Errorf("listed mutings %d times, want once", listings)
+	}
+	if len(mutings) != 1 || mutings[0].Filters[0] != DetectorFilter("D1") {
+		t.Errorf("mutings = %+v, want only D1's, since D2 is already muted", mutings)
+	}
+	if len(stats.MutedDetectors) != 2 {
+		t.Errorf("MutedDetectors = %v, want D1 and D2", stats.MutedDetectors)
+	}
+
+	opts.MuteOnResolve = 2 * DefaultMaxMuteDuration
+	if _, err := ResolveIncidents(context.Background(), client, incidents, opts); err == nil {
+		t.Error("muting for longer than MaxMuteDuration succeeded")
+	}
+}
@@ -0,0 +1,65 @@
+package janitor
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+)
+
+// Auth modes for SFXClientConfig.AuthMode
+const (
+	// AuthModeOrg authenticates every request with an org access token
+	AuthModeOrg = "org"
+	// AuthModeSession exchanges a user's email and password for a session
+	// token, see Authenticate
+	AuthModeSession = "session"
+)
+
+// Authenticate gets a session token when the client is in AuthModeSession.
+// It must be called before any other request is made, and does nothing in
+// AuthModeOrg.
+// https://developers.signalfx.com/sessiontokens_reference.html#tag/Create-Session-Token
+func (c *SFXClient) Authenticate(ctx context.Context) error {
+	if c.authMode != AuthModeSession {
+		return nil
+	}
+
+	data, _ := json.Marshal(map[string]string{
+		"email":          c.email,
+		"password":       c.password,
+		"organizationId": c.orgID,
+	})
+	req, err := c.newRequest(ctx, "POST", "v2/session", bytes.NewBuffer(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := c.doWithRetry(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		return fmt.Errorf("error creating session token: %w", newAPIError(resp))
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	session := struct {
+		AccessToken string `json:"accessToken"`
+	}{}
+	if err := json.Unmarshal(body, &session); err != nil {
+		return newDecodeError(resp, body, err)
+	}
+	if session.AccessToken == "" {
+		return fmt.Errorf("error creating session token: no accessToken in response")
+	}
+
+	c.token = session.AccessToken
+	return nil
+}
@@ -0,0 +1,114 @@
+package janitor
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"strings"
+)
+
+// Team (V2 API)
+type Team struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+}
+
+// Teams (V2 API)
+type Teams struct {
+	Count   int    `json:"count"`
+	Results []Team `json:"results"`
+}
+
+// teamPageSize is how many teams are requested at a time
+const teamPageSize = 100
+
+// ListTeamsByName pages through the teams whose names match name. SignalFX
+// matches partial names, so callers wanting an exact match should check.
+func (c *SFXClient) ListTeamsByName(ctx context.Context, name string) ([]Team, error) {
+	all := []Team{}
+	for offset := 0; ; offset += teamPageSize {
+		page, err := c.listTeamsPage(ctx, name, offset, teamPageSize)
+		if err != nil {
+			return []Team{}, err
+		}
+		all = append(all, page...)
+		if len(page) < teamPageSize {
+			return all, nil
+		}
+	}
+}
+
+func (c *SFXClient) listTeamsPage(ctx context.Context, name string, offset, limit int) ([]Team, error) {
+	req, err := c.newRequest(ctx, "GET", "v2/team", nil)
+	if err != nil {
+		return []Team{}, err
+	}
+	q := req.URL.Query()
+	q.Add("name", name)
+	q.Add("offset", strconv.Itoa(offset))
+	q.Add("limit", strconv.Itoa(limit))
+	req.URL.RawQuery = q.Encode()
+
+	resp, err := c.doWithRetry(req)
+	if err != nil {
+		return []Team{}, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		return []Team{}, newAPIError(resp)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return []Team{}, err
+	}
+	teams := new(Teams)
+	if err := json.Unmarshal(body, &teams); err != nil {
+		return []Team{}, newDecodeError(resp, body, err)
+	}
+	return teams.Results, nil
+}
+
+// TeamID finds the ID of the team called team, case-insensitively. If no
+// team has that name, team is taken to be an ID already.
+func TeamID(ctx context.Context, client *SFXClient, team string) (string, error) {
+	teams, err := client.ListTeamsByName(ctx, team)
+	if err != nil {
+		return "", err
+	}
+	exact := []string{}
+	for _, t := range teams {
+		if strings.EqualFold(t.Name, team) {
+			exact = append(exact, t.ID)
+		}
+	}
+	switch len(exact) {
+	case 0:
+		return team, nil
+	case 1:
+		return exact[0], nil
+	default:
+		return "", fmt.Errorf("%d teams are named %q: %s", len(exact), team, strings.Join(exact, ", "))
+	}
+}
+
+// TeamDetectors gets the detectors linked to the team teamID. The detector
+// API can't filter by team, so this pages through every detector.
+func TeamDetectors(ctx context.Context, client *SFXClient, teamID string) ([]Detector, error) {
+	detectors, err := client.ListDetectorsByName(ctx, "")
+	if err != nil {
+		return []Detector{}, err
+	}
+	matching := []Detector{}
+	for _, d := range detectors {
+		for _, t := range d.Teams {
+			if t == teamID {
+				matching = append(matching, d)
+				break
+			}
+		}
+	}
+	return matching, nil
+}
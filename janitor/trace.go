@@ -0,0 +1,47 @@
+package janitor
+
+import (
+	"context"
+	"net/http"
+)
+
+// Tracer starts spans around the client's API calls. The span it returns
+// must be ended by the caller. See SFXClientConfig.Tracer.
+type Tracer interface {
+	Start(ctx context.Context, name string) (context.Context, Span)
+}
+
+// Span is a timed operation, e.g. one listing or one incident clear
+type Span interface {
+	// SetAttribute records value, a string, int or bool, under key
+	SetAttribute(key string, value interface{})
+	// End finishes the span, recording err if it's not nil
+	End(err error)
+}
+
+type spanKey struct{}
+
+// noopSpan is every span when there's no tracer
+type noopSpan struct{}
+
+func (noopSpan) SetAttribute(string, interface{}) {}
+func (noopSpan) End(error)                        {}
+
+// startSpan starts a span with the client's tracer, if it has one, and
+// keeps it in the returned context so requests made under it can record
+// their status code and retries
+func (c *SFXClient) startSpan(ctx context.Context, name string) (context.Context, Span) {
+	if c.tracer == nil {
+		return ctx, noopSpan{}
+	}
+	ctx, span := c.tracer.Start(ctx, name)
+	return context.WithValue(ctx, spanKey{}, span), span
+}
+
+// spanFromRequest is the span req was made under, if any
+func spanFromRequest(req *http.Request) Span {
+	if span, ok := req.Context().Value(spanKey{}).(Span); ok {
+		return span
+	}
+	return noopSpan{}
+}
@@ -1,247 +1,1694 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
+	"context"
+	"crypto/x509"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
+	"math/rand"
 	"net/http"
 	"os"
+	"os/signal"
+	"regexp"
+	"sort"
 	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"text/tabwriter"
+	"text/template"
 	"time"
 
 	"github.com/Clever/configure"
-)
 
-const baseURL = "https://api.signalfx.com/"
+	"github.com/Clever/signalfx-janitor/janitor"
+)
 
-var sfxToken = envOrDie("SFX_TOKEN")
-var sfxOrgID = envOrDie("SFX_ORG_ID")
+// parseRegexp compiles the value of flag, returning nil if it's empty
+func parseRegexp(flag, value string) (*regexp.Regexp, error) {
+	if value == "" {
+		return nil, nil
+	}
+	re, err := regexp.Compile(value)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing %s: %s", flag, err)
+	}
+	return re, nil
+}
 
-func envOrDie(s string) string {
-	value := os.Getenv(s)
+// parseSeverity parses the value of flag, returning SeverityUnknown if it's empty
+func parseSeverity(flag, value string) (janitor.Severity, error) {
 	if value == "" {
-		log.Fatalf("env var %s is required", s)
+		return janitor.SeverityUnknown, nil
 	}
-	return value
+	severity, err := janitor.ParseSeverity(value)
+	if err != nil {
+		return janitor.SeverityUnknown, fmt.Errorf("error parsing %s: %s", flag, err)
+	}
+	return severity, nil
 }
 
-func main() {
-	flags := struct {
-		Task        string `config:"task,required"`
-		Detector    string `config:"detector"`
-		Duration    string `config:"duration"`
-		Description string `config:"description"`
-	}{
-		Task: "stale",
+// parsePriorities parses a comma-separated list of sf_priority values and
+// ranges, e.g. "0,1" or "0-2"
+func parsePriorities(value string) ([]int, error) {
+	priorities := []int{}
+	for _, item := range splitList(value) {
+		low, high := item, item
+		if n := strings.Index(item, "-"); n >= 0 {
+			low, high = item[:n], item[n+1:]
+		}
+		from, err := strconv.Atoi(strings.TrimSpace(low))
+		if err != nil || from < 0 || from > 4 {
+			return nil, fmt.Errorf("priority must be priorities or ranges of them between 0 and 4: %s", value)
+		}
+		to, err := strconv.Atoi(strings.TrimSpace(high))
+		if err != nil || to < from || to > 4 {
+			return nil, fmt.Errorf("priority must be priorities or ranges of them between 0 and 4: %s", value)
+		}
+		for p := from; p <= to; p++ {
+			priorities = append(priorities, p)
+		}
 	}
+	return priorities, nil
+}
 
-	if err := configure.Configure(&flags); err != nil {
-		log.Fatalf("Configure parse error: " + err.Error())
+// tokensOrDie returns the comma-separated tokens in token if set, otherwise
+// the tokens read one per line from tokenFile (e.g. a mounted secret)
+func tokensOrDie(token, tokenFile string) []string {
+	if token != "" {
+		return splitList(token)
+	}
+	if tokenFile == "" {
+		log.Fatal("env var SFX_TOKEN or SFX_TOKEN_FILE is required")
+	}
+	data, err := ioutil.ReadFile(tokenFile)
+	if err != nil {
+		log.Fatalf("error reading token file: %s", err)
 	}
+	tokens := strings.Fields(string(data))
+	if len(tokens) == 0 {
+		log.Fatalf("token file %s is empty", tokenFile)
+	}
+	return tokens
+}
 
-	switch flags.Task {
-	case "stale":
-		incidents, err := GetV1Incidents()
-		if err != nil {
-			log.Fatal("error looking up incidents:", err.Error())
+// rootCAsOrDie returns the system CAs plus those in the PEM file caCert, or
+// nil (meaning just the system CAs) if caCert is empty
+func rootCAsOrDie(caCert string) *x509.CertPool {
+	if caCert == "" {
+		return nil
+	}
+	pem, err := ioutil.ReadFile(caCert)
+	if err != nil {
+		log.Fatalf("error reading ca-cert: %s", err)
+	}
+	pool, err := x509.SystemCertPool()
+	if err != nil {
+		pool = x509.NewCertPool()
+	}
+	if !pool.AppendCertsFromPEM(pem) {
+		log.Fatalf("no certificates found in ca-cert %s", caCert)
+	}
+	return pool
+}
+
+// options are the janitor's settings, from flags, env, and the config file
+type options struct {
+	Task            string `config:"task,required"`
+	Detector        string `config:"detector"`
+	IncidentID      string `config:"incident-id"`
+	DetectorName    string `config:"detector-name"`
+	NameContains    string `config:"name-contains"`
+	DetectorNameHas string `config:"detector-name-contains"`
+	Team            string `config:"team"`
+	ServerTime      bool   `config:"server-time"`
+	Yes             bool   `config:"yes"`
+	DetectorsFile   string `config:"detectors-file"`
+	Duration        string `config:"duration"`
+	Description     string `config:"description"`
+	DescriptionTmpl string `config:"description-template"`
+	Realm           string `config:"realm"`
+	APIURL          string `config:"api-url"`
+	PageSize        string `config:"page-size"`
+	Limit           string `config:"limit"`
+	StaleAfter      string `config:"stale-after"`
+	MinAge          string `config:"min-age"`
+	RecentUpdate    string `config:"skip-clear-on-recent-update"`
+	DryRun          bool   `config:"dry-run"`
+	HTTPTimeout     string `config:"http-timeout"`
+	MaxRetries      string `config:"max-retries"`
+	ParseRetries    string `config:"retry-on-parse-error"`
+	Output          string `config:"output"`
+	Color           string `config:"color"`
+	Format          string `config:"format"`
+	Concurrency     string `config:"concurrency"`
+	RPS             string `config:"requests-per-second"`
+	Filter          string `config:"filter"`
+	Start           string `config:"start"`
+	Stop            string `config:"stop"`
+	SkipAuth        bool   `config:"skip-auth-check"`
+	Force           bool   `config:"force"`
+	MaxMuteDuration string `config:"max-mute-duration"`
+	AllowLongMute   bool   `config:"allow-long-mute"`
+	FailOnEmpty     bool   `config:"fail-on-empty"`
+	Confirm         bool   `config:"confirm"`
+	TokenFile       string `config:"token-file"`
+	CACert          string `config:"ca-cert"`
+	DetectorFilter  string `config:"detector-filter"`
+	DetectorType    string `config:"detector-type"`
+	IncludeMuted    bool   `config:"include-muted"`
+	RequireMuted    bool   `config:"require-muted"`
+	ExcludeDetector string `config:"exclude-detector"`
+	APIVersion      string `config:"api-version"`
+	MinSeverity     string `config:"min-severity"`
+	MaxSeverity     string `config:"max-severity"`
+	Priority        string `config:"priority"`
+	SlackWebhook    string `config:"slack-webhook"`
+	SlackAlways     bool   `config:"slack-always"`
+	ErrorWebhook    string `config:"error-webhook"`
+	Query           string `config:"query"`
+	AnomalyStates   string `config:"anomaly-states"`
+	LogLevel        string `config:"log-level"`
+	Timezone        string `config:"timezone"`
+	Token           string `config:"token"`
+	OrgID           string `config:"org-id"`
+	AllowedOrgs     string `config:"allowed-orgs"`
+	Config          string `config:"config"`
+	MetricsAddr     string `config:"metrics-addr"`
+	Since           string `config:"since"`
+	DetectorQuery   string `config:"detector-query"`
+	Rules           string `config:"rules"`
+	MaxResolve      string `config:"max-resolve"`
+	MuteOnResolve   string `config:"mute-on-resolve"`
+	AuditFile       string `config:"audit-file"`
+	StateFile       string `config:"state-file"`
+	AuthMode        string `config:"auth-mode"`
+	Email           string `config:"email"`
+	Password        string `config:"password"`
+	Interval        string `config:"interval"`
+	StartupJitter   string `config:"startup-jitter"`
+	DurationMult    string `config:"duration-multiplier"`
+	UserAgent       string `config:"user-agent"`
+	GroupByDetector bool   `config:"group-by-detector"`
+	GroupOnly       bool   `config:"group-only"`
+	HealthAddr      string `config:"health-addr"`
+}
+
+// loadOptions reads the settings, from defaults, then the config file, then
+// env, then flags. It returns flag.ErrHelp for -h.
+func loadOptions() (options, error) {
+	flags := options{
+		Task:            "stale",
+		PageSize:        strconv.Itoa(janitor.DefaultPageSize),
+		Limit:           "0",
+		StaleAfter:      "30m",
+		MinAge:          "5m",
+		StartupJitter:   "0",
+		DurationMult:    "0",
+		RecentUpdate:    "5m",
+		HTTPTimeout:     janitor.DefaultHTTPTimeout.String(),
+		MaxRetries:      "3",
+		ParseRetries:    "0",
+		MaxResolve:      "0",
+		MaxMuteDuration: janitor.DefaultMaxMuteDuration.String(),
+		Output:          "text",
+		Color:           "auto",
+		Concurrency:     "5",
+		RPS:             "5",
+		APIVersion:      "v1",
+		DetectorType:    "all",
+		Query:           janitor.DefaultIncidentQuery,
+		LogLevel:        "info",
+		Timezone:        "UTC",
+		AuthMode:        janitor.AuthModeOrg,
+	}
+
+	// settings come from defaults, then the config file, then env, then flags
+	if path := configFilePath(os.Args[1:]); path != "" {
+		if err := applyConfigFile(path, &flags); err != nil {
+			return flags, fmt.Errorf("error reading config file: %w", err)
 		}
+	}
+	envOverride(&flags.Realm, "SFX_REALM")
+	envOverride(&flags.APIURL, "SFX_API_URL")
+	envOverride(&flags.TokenFile, "SFX_TOKEN_FILE")
+	envOverride(&flags.SlackWebhook, "SLACK_WEBHOOK_URL")
+	envOverride(&flags.Token, "SFX_TOKEN")
+	envOverride(&flags.OrgID, "SFX_ORG_ID")
+	envOverride(&flags.Email, "SFX_EMAIL")
+	envOverride(&flags.Password, "SFX_PASSWORD")
 
-		log.Printf("Found %d incidents\n", len(incidents))
+	if err := configure.Configure(&flags); err == flag.ErrHelp {
+		return flags, err
+	} else if err != nil {
+		return flags, fmt.Errorf("Configure parse error: %w", err)
+	}
+	return flags, nil
+}
 
-		err = resolveIncidents(incidents)
-		if err != nil {
-			log.Fatal("error resolving incidents:", err.Error())
+func main() {
+	// seed the retry jitter so concurrent janitors don't retry in lockstep
+	rand.Seed(time.Now().UnixNano())
+
+	flags, err := loadOptions()
+	if err == flag.ErrHelp {
+		printUsageNotes(os.Stderr)
+		os.Exit(exitOK)
+	} else if err != nil {
+		log.Fatal(err.Error())
+	}
+
+	// every absolute time the janitor prints, including the library's log
+	// lines and log timestamps, is formatted in the local zone
+	loc, err := time.LoadLocation(flags.Timezone)
+	if err != nil {
+		log.Fatal("error parsing timezone: ", err.Error())
+	}
+	time.Local = loc
+
+	level, err := janitor.ParseLogLevel(flags.LogLevel)
+	if err != nil {
+		log.Fatal("error parsing log-level:", err.Error())
+	}
+	logger := janitor.NewLogger(os.Stderr, level)
+
+	ctx := cancelOnSignal(logger)
+
+	maxMuteDuration, err := time.ParseDuration(flags.MaxMuteDuration)
+	if err != nil {
+		log.Fatal("error parsing max-mute-duration:", err.Error())
+	}
+	if flags.AllowLongMute {
+		maxMuteDuration = 0
+	}
+
+	if err := validateRunOptions(flags, maxMuteDuration); err != nil {
+		log.Fatal(err.Error())
+	}
+	var onAPIError func(int)
+	var runMetrics *metrics
+	if flags.MetricsAddr != "" {
+		// a single run exits before anything could scrape it
+		if flags.Interval == "" {
+			log.Fatal("metrics-addr requires interval")
 		}
-	case "mute":
-		if flags.Detector == "" || flags.Duration == "" {
-			log.Fatal("mute requires both detector and duration flags")
+		runMetrics = newMetrics()
+		onAPIError = runMetrics.observeAPIError
+		serveMetrics(flags.MetricsAddr, runMetrics, logger)
+	}
+	// only set the client's Tracer when tracing is on, so it isn't a
+	// non-nil interface holding a nil *tracer
+	var clientTracer janitor.Tracer
+	runTracer := newTracerFromEnv()
+	if runTracer != nil {
+		clientTracer = runTracer
+	}
+
+	httpTimeout, err := time.ParseDuration(flags.HTTPTimeout)
+	if err != nil {
+		log.Fatal("error parsing http-timeout:", err.Error())
+	}
+	if httpTimeout <= 0 {
+		log.Fatal("http-timeout must be positive:", flags.HTTPTimeout)
+	}
+
+	maxRetries, err := strconv.Atoi(flags.MaxRetries)
+	if err != nil || maxRetries < 0 {
+		log.Fatal("max-retries must be a non-negative integer:", flags.MaxRetries)
+	}
+
+	parseRetries, err := strconv.Atoi(flags.ParseRetries)
+	if err != nil || parseRetries < 0 {
+		log.Fatal("retry-on-parse-error must be a non-negative integer:", flags.ParseRetries)
+	}
+
+	rps, err := strconv.ParseFloat(flags.RPS, 64)
+	if err != nil || rps < 0 {
+		log.Fatal("requests-per-second must be a non-negative number:", flags.RPS)
+	}
+
+	if flags.OrgID == "" {
+		log.Fatal("env var SFX_ORG_ID is required")
+	}
+	if allowed := splitList(flags.AllowedOrgs); len(allowed) > 0 && !contains(allowed, flags.OrgID) {
+		log.Fatalf("SFX_ORG_ID %s is not in allowed-orgs %s", flags.OrgID, strings.Join(allowed, ","))
+	}
+
+	var tokens []string
+	switch flags.AuthMode {
+	case janitor.AuthModeOrg:
+		tokens = tokensOrDie(flags.Token, flags.TokenFile)
+	case janitor.AuthModeSession:
+		if flags.Email == "" || flags.Password == "" {
+			log.Fatal("auth-mode session requires env vars SFX_EMAIL and SFX_PASSWORD")
 		}
+	default:
+		log.Fatal("auth-mode must be one of org, session:", flags.AuthMode)
+	}
 
-		duration, err := time.ParseDuration(flags.Duration)
-		if err != nil {
-			log.Fatal("error looking up incidents:", err.Error())
+	clientConfig := janitor.SFXClientConfig{
+		BaseURL:           janitor.APIBaseURL(flags.Realm, flags.APIURL),
+		Token:             firstOrEmpty(tokens),
+		FallbackTokens:    restOrNil(tokens),
+		OrgID:             flags.OrgID,
+		AuthMode:          flags.AuthMode,
+		Email:             flags.Email,
+		Password:          flags.Password,
+		Timeout:           httpTimeout,
+		MaxRetries:        maxRetries,
+		ParseRetries:      parseRetries,
+		RequestsPerSecond: rps,
+		RootCAs:           rootCAsOrDie(flags.CACert),
+		Logger:            logger,
+		OnAPIError:        onAPIError,
+		UserAgent:         userAgent(flags.UserAgent),
+		Tracer:            clientTracer,
+	}
+	client := janitor.NewSFXClient(clientConfig)
+
+	if err := client.Authenticate(ctx); err != nil {
+		log.Fatal("error authenticating: ", err.Error())
+	}
+	if !flags.SkipAuth {
+		if err := client.CheckAuth(ctx); err != nil {
+			if janitor.IsUnauthorized(err) && flags.APIURL == "" && flags.AuthMode == janitor.AuthModeOrg {
+				current := flags.Realm
+				if current == "" {
+					current = "us0"
+				}
+				if realm := janitor.DetectRealm(ctx, clientConfig); realm != "" && realm != current {
+					log.Fatalf("preflight check failed: %s (the token belongs to realm %s; set SFX_REALM=%s)", err, realm, realm)
+				}
+			}
+			log.Fatal("preflight check failed: ", err.Error())
 		}
+	}
 
-		err = muteDetector(flags.Detector, duration, flags.Description)
-		if err != nil {
-			log.Fatal("error muting detector:", err.Error())
+	jitter, err := time.ParseDuration(flags.StartupJitter)
+	if err != nil || jitter < 0 {
+		log.Fatal("startup-jitter must be a non-negative duration:", flags.StartupJitter)
+	}
+
+	if flags.Interval == "" {
+		if flags.HealthAddr != "" {
+			log.Fatal("health-addr requires interval")
 		}
-	default:
-		log.Fatal("unexpected task:", flags.Task)
+		if err := sleepJitter(ctx, jitter, logger); err != nil {
+			logger.Infof("stopping")
+			return
+		}
+		summary, taskErr := runOnce(ctx, client, flags, logger, maxMuteDuration, runMetrics, runTracer)
+		if code := exitCode(taskErr, summary); code != exitOK {
+			os.Exit(code)
+		}
+		return
+	}
+
+	interval, err := time.ParseDuration(flags.Interval)
+	if err != nil || interval <= 0 {
+		log.Fatal("interval must be a positive duration:", flags.Interval)
 	}
+	if jitter >= interval {
+		log.Fatal("startup-jitter must be shorter than interval:", flags.StartupJitter)
+	}
+	var runHealth *health
+	if flags.HealthAddr != "" {
+		// a run may be skipped if the one before it overran, so allow for two
+		runHealth = newHealth(client, 2*interval+httpTimeout)
+		serveHealth(flags.HealthAddr, runHealth, logger)
+	}
+	current := reloadOnHangup(flags, logger, maxMuteDuration)
+	runEvery(ctx, interval, logger, func() {
+		if err := sleepJitter(ctx, jitter, logger); err != nil {
+			return
+		}
+		runOnce(ctx, client, current(), logger, maxMuteDuration, runMetrics, runTracer)
+		if runHealth != nil {
+			runHealth.observeRun(time.Now())
+		}
+	})
 }
 
-// SimpleIncident represents a SignalFX incident
-type SimpleIncident struct {
-	Label     string
-	ID        string
-	CreatedAt time.Time
+// reloadOnHangup re-reads the settings whenever the process gets SIGHUP, if a
+// config file is set, and returns a func giving the latest ones. Runs already
+// in progress keep the settings they started with, and settings that fail
+// validateRunOptions are logged and ignored.
+func reloadOnHangup(flags options, logger janitor.Logger, maxMuteDuration time.Duration) func() options {
+	var mu sync.Mutex
+	current := flags
+	if flags.Config != "" {
+		hangups := make(chan os.Signal, 1)
+		signal.Notify(hangups, syscall.SIGHUP)
+		go func() {
+			for range hangups {
+				reloaded, err := loadOptions()
+				if err != nil {
+					logger.Errorf("error reloading settings, keeping the current ones: %s", err)
+					continue
+				}
+				if err := validateRunOptions(reloaded, maxMuteDuration); err != nil {
+					logger.Errorf("invalid reloaded settings, keeping the current ones: %s", err)
+					continue
+				}
+				mu.Lock()
+				logChangedSettings(logger, current, reloaded)
+				current = reloaded
+				mu.Unlock()
+			}
+		}()
+	}
+	return func() options {
+		mu.Lock()
+		defer mu.Unlock()
+		return current
+	}
 }
 
-func (si SimpleIncident) String() string {
-	timeAgo := time.Now().Sub(si.CreatedAt)
-	return fmt.Sprintf("%s (time ago = %s)", si.Label, timeAgo)
+// sleepJitter sleeps for a random duration from 0 up to jitter, logging
+// it, so instances on the same schedule don't all hit the API at once. It
+// returns ctx's error if ctx is cancelled first.
+func sleepJitter(ctx context.Context, jitter time.Duration, logger janitor.Logger) error {
+	if jitter <= 0 {
+		return nil
+	}
+	delay := time.Duration(rand.Int63n(int64(jitter)))
+	logger.Infof("Sleeping %s (startup-jitter %s) before running", delay.Round(time.Millisecond), jitter)
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
 }
 
-// GetV1Incidents gets an array of SimpleIncidents
-func GetV1Incidents() ([]SimpleIncident, error) {
-	eventTimeSeries, err := listActiveIncidentsV1()
-	if err != nil {
-		return []SimpleIncident{}, err
+// runEvery calls run now and then every interval until ctx is cancelled.
+// Runs never overlap: if one takes longer than interval, the runs it
+// overlapped are skipped.
+func runEvery(ctx context.Context, interval time.Duration, logger janitor.Logger, run func()) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		run()
+		select {
+		case <-ticker.C:
+			logger.Warnf("run took longer than interval %s, skipping the overlapping run", interval)
+		default:
+		}
+		select {
+		case <-ctx.Done():
+			logger.Infof("stopping")
+			return
+		case <-ticker.C:
+		}
 	}
+}
 
-	incidents := []SimpleIncident{}
-	for _, series := range eventTimeSeries {
-		updatedAt := time.Unix(int64(series.UpdatedOnMs/1000), 0)
-		label := fmt.Sprint(series.SfDetector, " -- ", series.SfDetectorID)
-		incidents = append(incidents, SimpleIncident{
-			ID:        series.IncidentID,
-			CreatedAt: updatedAt,
-			Label:     label,
-		})
+// runOnce runs flags.Task, then reports the result to metrics, stdout (with
+// --output json), and the log
+func runOnce(ctx context.Context, client *janitor.SFXClient, flags options, logger janitor.Logger, maxMuteDuration time.Duration, runMetrics *metrics, runTracer *tracer) (*runSummary, error) {
+	summary := &runSummary{Task: flags.Task, Errors: []string{}}
+	start := time.Now()
+	var runSpan janitor.Span
+	if runTracer != nil {
+		ctx, runSpan = runTracer.Start(ctx, flags.Task)
+	}
+	taskErr := runTask(ctx, client, flags, logger, maxMuteDuration, summary)
+	if runSpan != nil {
+		runSpan.SetAttribute("org.id", flags.OrgID)
+		runSpan.SetAttribute("dry_run", summary.DryRun)
+		runSpan.SetAttribute("incidents.found", summary.Found)
+		runSpan.SetAttribute("incidents.resolved", summary.Resolved)
+		runSpan.SetAttribute("incidents.failed", summary.Failed)
+		runSpan.End(taskErr)
+		runTracer.flush(logger)
 	}
 
-	return incidents, nil
+	var errs janitor.MultiError
+	if errors.As(taskErr, &errs) {
+		for _, err := range errs {
+			summary.addError(err)
+		}
+	} else if taskErr != nil {
+		summary.addError(taskErr)
+	}
+	if runMetrics != nil {
+		runMetrics.observeRun(summary, time.Since(start))
+	}
+	if flags.ErrorWebhook != "" && len(summary.Errors) > 0 {
+		if err := notifyErrorWebhook(flags.ErrorWebhook, flags.OrgID, summary); err != nil {
+			logger.Warnf("error notifying error-webhook: %s", err)
+		}
+	}
+	if flags.Output == "json" {
+		summary.DurationSeconds = time.Since(start).Seconds()
+		if err := json.NewEncoder(os.Stdout).Encode(summary); err != nil {
+			logger.Errorf("error writing summary: %s", err)
+		}
+	}
+	if taskErr != nil {
+		logger.Errorf("%s", taskErr)
+	}
+	return summary, taskErr
 }
 
-func resolveIncidents(incidents []SimpleIncident) error {
-	for _, i := range incidents {
-		log.Println("Incident:", i)
-		shouldAutoResolve := i.CreatedAt.Before(time.Now().Add(-30 * time.Minute))
-		log.Println("Should auto resolve:", shouldAutoResolve)
-		if shouldAutoResolve {
-			err := clearIncident(i.ID)
-			if err != nil {
-				return fmt.Errorf("error resolving incident %s: %s ", i.ID, err.Error())
-			}
+// validateRunOptions checks the settings each run uses without calling the
+// API, so bad ones are rejected at startup and on reload
+func validateRunOptions(flags options, maxMuteDuration time.Duration) error {
+	if flags.Output != "text" && flags.Output != "table" && flags.Output != "json" && flags.Output != "jsonl" && flags.Output != "count" {
+		return fmt.Errorf("output must be one of text, table, json, jsonl, count: %s", flags.Output)
+	}
+	if flags.Output == "count" {
+		switch flags.Task {
+		case "stale", "report", "resolve-by-detector", "list-incidents":
+		default:
+			return errors.New("output count only works with the stale, report, resolve-by-detector, and list-incidents tasks")
+		}
+		if flags.Format != "" {
+			return errors.New("format can't be combined with output count")
+		}
+	}
+	if flags.Output == "jsonl" {
+		switch flags.Task {
+		case "report", "list-incidents", "list-detectors", "list-mutings":
+		default:
+			return errors.New("output jsonl only works with the report, list-incidents, list-detectors, and list-mutings tasks")
+		}
+	}
+	if flags.Output == "json" && flags.Format != "" {
+		return errors.New("format can't be combined with output json, which only prints the run's summary")
+	}
+	if flags.GroupOnly {
+		if flags.Task != "report" && flags.Task != "list-incidents" {
+			return errors.New("group-only only works with the report and list-incidents tasks")
+		}
+		if flags.Format != "" || flags.Output != "text" {
+			return fmt.Errorf("group-only prints a table, so it can't be combined with format or output %s", flags.Output)
 		}
-		log.Println("")
 	}
 
+	switch flags.Task {
+	case "stale", "report", "resolve-by-detector", "list-incidents":
+		_, err := parseStaleSettings(flags, maxMuteDuration)
+		return err
+	case "mute":
+		_, err := parseMuteFilters(flags)
+		return err
+	case "unmute":
+		if flags.Detector == "" {
+			return errors.New("unmute requires the detector flag")
+		}
+	case "clear":
+		if len(splitList(flags.IncidentID)) == 0 {
+			return errors.New("clear requires the incident-id flag")
+		}
+	case "list-detectors", "list-mutings":
+	default:
+		return fmt.Errorf("unexpected task: %s", flags.Task)
+	}
 	return nil
 }
 
-// EventTimeSeries (V1 API)
-type EventTimeSeries struct {
-	RS []EventTimeSeriesRS `json:"rs"`
+// staleSettings are what the stale, report, resolve-by-detector, and
+// list-incidents tasks parse from their flags
+type staleSettings struct {
+	list    janitor.ListOptions
+	resolve janitor.ResolveOptions
+	format  *template.Template // nil without --format
+	color   bool
 }
 
-// EventTimeSeriesRS (V1 API)
-type EventTimeSeriesRS struct {
-	IncidentID   string  `json:"sf_incidentId"`
-	UpdatedOnMs  float64 `json:"sf_updatedOnMs"`
-	SfDetector   string  `json:"sf_detector"`
-	SfDetectorID string  `json:"sf_detectorId"`
-}
+// parseStaleSettings parses the flags of the stale, report,
+// resolve-by-detector, and list-incidents tasks. The returned
+// ResolveOptions have no OnResolved, which needs the audit-file open.
+func parseStaleSettings(flags options, maxMuteDuration time.Duration) (staleSettings, error) {
+	var settings staleSettings
+	if flags.Task == "resolve-by-detector" && flags.Detector == "" {
+		return settings, errors.New("resolve-by-detector requires the detector flag")
+	}
 
-func listActiveIncidentsV1() ([]EventTimeSeriesRS, error) {
-	url := baseURL + "v1/eventtimeseries"
-	client := &http.Client{}
-	req, err := http.NewRequest("GET", url, nil)
+	pageSize, err := strconv.Atoi(flags.PageSize)
+	if err != nil || pageSize <= 0 {
+		return settings, fmt.Errorf("page-size must be a positive integer: %s", flags.PageSize)
+	}
+
+	staleAfter, err := time.ParseDuration(flags.StaleAfter)
 	if err != nil {
-		return []EventTimeSeriesRS{}, err
+		return settings, fmt.Errorf("error parsing stale-after: %s", err)
+	}
+	if staleAfter <= 0 {
+		return settings, fmt.Errorf("stale-after must be positive: %s", flags.StaleAfter)
 	}
 
-	// Add query params
-	q := req.URL.Query()
-	q.Add("query", `sf_organizationID:`+sfxOrgID+` AND (NOT sf_archived:true) AND ((((sf_anomalyState:("anomalous" "too high" "too low"))) AND (sf_detector.lowercase:* OR sf_displayName.lowercase:*)))`)
-	// TODO: Properly page through results
-	q.Add("offset", strconv.Itoa(0))
-	q.Add("limit", strconv.Itoa(500))
-	q.Add("order_by", `-sf_priority,-sf_anomalyStateUpdateTimestampMs`)
-	req.URL.RawQuery = q.Encode()
+	concurrency, err := strconv.Atoi(flags.Concurrency)
+	if err != nil || concurrency <= 0 {
+		return settings, fmt.Errorf("concurrency must be a positive integer: %s", flags.Concurrency)
+	}
+
+	detectorType := flags.DetectorType
+	switch detectorType {
+	case "all":
+		detectorType = ""
+	case janitor.DetectorTypeV1, janitor.DetectorTypeV2:
+	default:
+		return settings, fmt.Errorf("detector-type must be one of v1, v2, all: %s", flags.DetectorType)
+	}
 
-	req.Header.Set("X-SF-TOKEN", sfxToken)
-	resp, err := client.Do(req)
+	durationMultiplier, err := strconv.ParseFloat(flags.DurationMult, 64)
+	if err != nil || durationMultiplier < 0 {
+		return settings, fmt.Errorf("duration-multiplier must be a non-negative number: %s", flags.DurationMult)
+	}
+
+	limit, err := strconv.Atoi(flags.Limit)
+	if err != nil || limit < 0 {
+		return settings, fmt.Errorf("limit must be a non-negative integer: %s", flags.Limit)
+	}
+
+	query := flags.Query
+	if flags.AnomalyStates != "" {
+		if query != janitor.DefaultIncidentQuery {
+			return settings, errors.New("anomaly-states can't be combined with query")
+		}
+		query, err = janitor.IncidentQuery(splitList(flags.AnomalyStates))
+		if err != nil {
+			return settings, fmt.Errorf("error parsing anomaly-states: %s", err)
+		}
+	}
+
+	var detectorQuery string
+	if flags.DetectorQuery != "" {
+		if flags.APIVersion != "v1" {
+			return settings, errors.New("detector-query requires api-version v1")
+		}
+		var ids, names []string
+		for _, item := range splitList(flags.DetectorQuery) {
+			if strings.HasPrefix(item, "name:") {
+				names = append(names, strings.TrimPrefix(item, "name:"))
+			} else {
+				ids = append(ids, item)
+			}
+		}
+		detectorQuery, err = janitor.DetectorQuery(ids, names)
+		if err != nil {
+			return settings, fmt.Errorf("error parsing detector-query: %s", err)
+		}
+	}
+
+	var since time.Duration
+	if flags.Since != "" {
+		since, err = time.ParseDuration(flags.Since)
+		if err != nil {
+			return settings, fmt.Errorf("error parsing since: %s", err)
+		}
+		if since <= 0 {
+			return settings, fmt.Errorf("since must be positive: %s", flags.Since)
+		}
+	}
+
+	maxResolve, err := strconv.Atoi(flags.MaxResolve)
+	if err != nil || maxResolve < 0 {
+		return settings, fmt.Errorf("max-resolve must be a non-negative integer: %s", flags.MaxResolve)
+	}
+
+	var muteOnResolve time.Duration
+	if flags.MuteOnResolve != "" {
+		muteOnResolve, err = time.ParseDuration(flags.MuteOnResolve)
+		if err != nil {
+			return settings, fmt.Errorf("error parsing mute-on-resolve: %s", err)
+		}
+		if err := janitor.CheckMuteDuration(muteOnResolve, maxMuteDuration); err != nil {
+			return settings, fmt.Errorf("invalid mute-on-resolve (pass allow-long-mute to override the maximum): %s", err)
+		}
+	}
+
+	var rules []janitor.StaleRule
+	if flags.Rules != "" {
+		rules, err = loadRules(flags.Rules)
+		if err != nil {
+			return settings, fmt.Errorf("error loading rules: %s", err)
+		}
+	}
+
+	recentUpdate, err := time.ParseDuration(flags.RecentUpdate)
+	if err != nil || recentUpdate < 0 {
+		return settings, fmt.Errorf("skip-clear-on-recent-update must be a non-negative duration: %s", flags.RecentUpdate)
+	}
+
+	detectorFilter, err := parseRegexp("detector-filter", flags.DetectorFilter)
 	if err != nil {
-		return []EventTimeSeriesRS{}, err
+		return settings, err
 	}
-	body, err := ioutil.ReadAll(resp.Body)
+	excludeDetector, err := parseRegexp("exclude-detector", flags.ExcludeDetector)
 	if err != nil {
-		return []EventTimeSeriesRS{}, err
+		return settings, err
 	}
-	s := new(EventTimeSeries)
-	err = json.Unmarshal(body, &s)
+	minSeverity, err := parseSeverity("min-severity", flags.MinSeverity)
 	if err != nil {
-		return []EventTimeSeriesRS{}, err
+		return settings, err
+	}
+	maxSeverity, err := parseSeverity("max-severity", flags.MaxSeverity)
+	if err != nil {
+		return settings, err
+	}
+	priorities, err := parsePriorities(flags.Priority)
+	if err != nil {
+		return settings, err
 	}
-	return s.RS, nil
-}
 
-// clearIncident works for V1 and V2 detectors
-// https://developers.signalfx.com/v2/reference#incidentidclear
-func clearIncident(incidentID string) error {
-	url := baseURL + "v2/incident/" + incidentID + "/clear"
-	req, err := http.NewRequest("PUT", url, nil)
+	settings.color, err = useColor(flags.Color, os.Stdout)
 	if err != nil {
-		return err
+		return settings, fmt.Errorf("error parsing color: %s", err)
+	}
+	if flags.Format != "" {
+		settings.format, err = parseFormat(flags.Format)
+		if err != nil {
+			return settings, fmt.Errorf("error parsing format: %s", err)
+		}
 	}
-	req.Header.Set("X-SF-TOKEN", sfxToken)
-	req.Header.Set("Content-Type", "application/json")
 
-	client := &http.Client{}
-	resp, err := client.Do(req)
+	settings.list = janitor.ListOptions{
+		APIVersion:    flags.APIVersion,
+		PageSize:      pageSize,
+		Limit:         limit,
+		Query:         query,
+		Since:         since,
+		DetectorQuery: detectorQuery,
+	}
+	settings.resolve = janitor.ResolveOptions{
+		RecentUpdate:       recentUpdate,
+		StaleAfter:         staleAfter,
+		Rules:              rules,
+		DurationMultiplier: durationMultiplier,
+		DryRun:             flags.DryRun,
+		Concurrency:        concurrency,
+		DetectorType:       detectorType,
+		IncludeMuted:       flags.IncludeMuted,
+		RequireMuted:       flags.RequireMuted,
+		DetectorFilter:     detectorFilter,
+		ExcludeDetector:    excludeDetector,
+		MinSeverity:        minSeverity,
+		MaxSeverity:        maxSeverity,
+		Priorities:         priorities,
+		MaxResolve:         maxResolve,
+		MuteOnResolve:      muteOnResolve,
+		MaxMuteDuration:    maxMuteDuration,
+	}
+	if flags.Task == "resolve-by-detector" || flags.Task == "list-incidents" {
+		minAge, err := time.ParseDuration(flags.MinAge)
+		if err != nil || minAge < 0 {
+			return settings, fmt.Errorf("min-age must be a non-negative duration: %s", flags.MinAge)
+		}
+		settings.resolve.AnyAge = true
+		settings.resolve.MinAge = minAge
+	}
+	if flags.Task == "resolve-by-detector" {
+		settings.resolve.DetectorID = flags.Detector
+	}
+	if flags.Task == "list-incidents" {
+		// list every active incident the filters match, however live it is
+		settings.resolve.RecentUpdate = 0
+		settings.resolve.IncludeMuted = true
+	}
+	return settings, nil
+}
+
+// parseMuteFilters checks the mute task has something to mute and parses
+// its --filter
+func parseMuteFilters(flags options) ([]janitor.AlertMutingFilter, error) {
+	if flags.Detector == "" && flags.DetectorName == "" && flags.DetectorNameHas == "" && flags.Team == "" && flags.DetectorsFile == "" && flags.Filter == "" {
+		return nil, errors.New("mute requires at least one of the detector, detector-name, detector-name-contains, team, detectors-file, or filter flags")
+	}
+	if (flags.Duration == "") == (flags.Stop == "") {
+		return nil, errors.New("mute requires exactly one of duration, or start and stop")
+	}
+	if flags.Stop != "" && flags.Start == "" {
+		return nil, errors.New("stop requires start")
+	}
+	filters, err := parseFilters(flags.Filter)
 	if err != nil {
-		return err
+		return nil, fmt.Errorf("error parsing filter: %s", err)
 	}
-	defer resp.Body.Close()
+	return filters, nil
+}
 
-	if resp.StatusCode != 200 {
-		body, err := ioutil.ReadAll(resp.Body)
+// runTask runs flags.Task once, filling in summary as it goes. flags must
+// have passed validateRunOptions.
+func runTask(ctx context.Context, client *janitor.SFXClient, flags options, logger janitor.Logger, maxMuteDuration time.Duration, summary *runSummary) error {
+	var taskErr error
+	switch flags.Task {
+	case "stale", "report", "resolve-by-detector", "list-incidents":
+		if flags.Confirm && !flags.DryRun && !isTerminal(os.Stdin) {
+			return errors.New("confirm needs an interactive terminal; use dry-run to preview unattended runs instead")
+		}
+		settings, err := parseStaleSettings(flags, maxMuteDuration)
 		if err != nil {
 			return err
 		}
-		log.Println("error:", string(body))
-		return fmt.Errorf("Error clearing incident %s, got StatusCode %d", incidentID, resp.StatusCode)
+		resolveOpts := settings.resolve
+		if flags.Task == "resolve-by-detector" {
+			logger.Infof("Resolving all incidents from detector %s", flags.Detector)
+		} else if flags.Task == "list-incidents" {
+			logger.Infof("Listing active incidents")
+		} else {
+			logger.Infof("Resolving incidents older than %s", resolveOpts.StaleAfter)
+		}
+
+		incidents, err := janitor.GetIncidents(ctx, client, settings.list)
+		if err != nil {
+			taskErr = fmt.Errorf("error looking up incidents: %w", err)
+			break
+		}
+
+		logger.Infof("Found %d incidents", len(incidents))
+		if len(incidents) == 0 {
+			if flags.FailOnEmpty {
+				taskErr = errors.New("no active incidents found, and fail-on-empty is set")
+				break
+			}
+			logger.Infof("No active incidents to process")
+		}
+		summary.Ages = janitor.AgeDistribution(incidents, time.Now())
+		if flags.StateFile != "" {
+			seen, err := loadSeenIncidents(flags.StateFile)
+			if err != nil {
+				logger.Warnf("error reading state-file, treating every incident as new: %s", err)
+			}
+			for n, i := range incidents {
+				incidents[n].New = !seen[i.ID]
+				if incidents[n].New {
+					summary.New++
+				}
+			}
+			logger.Infof("%d incidents are new since the last run", summary.New)
+			if err := saveSeenIncidents(flags.StateFile, incidents, time.Now()); err != nil {
+				logger.Errorf("error writing state-file: %s", err)
+			}
+		}
+		if err := janitor.FillMuted(ctx, client, incidents, time.Now()); err != nil {
+			taskErr = fmt.Errorf("error looking up mutings: %w", err)
+			break
+		}
+		if resolveOpts.DetectorType != "" {
+			if err := janitor.FillDetectorTypes(ctx, client, incidents); err != nil {
+				taskErr = fmt.Errorf("error looking up detector types: %w", err)
+				break
+			}
+		}
+		if resolveOpts.DurationMultiplier > 0 {
+			if err := janitor.FillDetectorDurations(ctx, client, incidents); err != nil {
+				taskErr = fmt.Errorf("error looking up detector durations: %w", err)
+				break
+			}
+		}
+
+		if flags.AuditFile != "" && !flags.DryRun {
+			audit, err := openAuditLog(flags.AuditFile)
+			if err != nil {
+				return fmt.Errorf("error opening audit-file: %s", err)
+			}
+			defer audit.Close()
+			resolveOpts.OnResolved = func(i janitor.SimpleIncident) {
+				if err := audit.Record(i, time.Now()); err != nil {
+					logger.Errorf("error writing audit-file: %s", err)
+				}
+			}
+		}
+		if flags.Task == "report" || flags.Task == "list-incidents" {
+			now := time.Now()
+			listed := resolveOpts.StaleIncidents(incidents, now)
+			summary.Found = len(incidents)
+			summary.Skipped = len(incidents) - len(listed)
+			title := "ACTIVE"
+			if flags.Task == "report" {
+				summary.Stale = len(listed)
+				title = "STALE"
+			}
+			if settings.format != nil {
+				if err := writeFormatted(os.Stdout, settings.format, listed, now); err != nil {
+					taskErr = fmt.Errorf("error formatting incidents: %w", err)
+				}
+			} else if flags.Output == "count" {
+				fmt.Fprintln(os.Stdout, len(listed))
+			} else if flags.Output == "jsonl" {
+				writeIncidentLines(os.Stdout, listed, now)
+			} else if flags.GroupOnly {
+				printDetectorSummary(os.Stdout, listed, now, title)
+			} else if flags.Output != "json" {
+				// with json, runOnce's summary is all of stdout
+				printReport(os.Stdout, listed, now, title)
+			}
+			break
+		}
+
+		if flags.Confirm && !flags.DryRun {
+			n := len(resolveOpts.StaleIncidents(incidents, time.Now()))
+			if resolveOpts.MaxResolve > 0 && n > resolveOpts.MaxResolve {
+				n = resolveOpts.MaxResolve
+			}
+			if n > 0 && !confirm(os.Stdin, os.Stderr, fmt.Sprintf("Resolve %d incidents?", n)) {
+				logger.Infof("Not resolving anything")
+				break
+			}
+		}
+
+		stats, err := janitor.ResolveIncidents(ctx, client, incidents, resolveOpts)
+		summary.DryRun = flags.DryRun
+		summary.Found = stats.Found
+		summary.Resolved = stats.Resolved
+		summary.Skipped = stats.Skipped
+		summary.AlreadyResolved = stats.AlreadyResolved
+		summary.Failed = stats.Failed
+		summary.Capped = stats.Capped
+		summary.Muted = stats.MutedDetectors
+		if settings.format != nil {
+			if err := writeFormatted(os.Stdout, settings.format, stats.ResolvedIncidents, time.Now()); err != nil {
+				logger.Errorf("error formatting incidents: %s", err)
+			}
+		} else if flags.Output == "count" {
+			fmt.Fprintln(os.Stdout, stats.Resolved)
+		} else if flags.Output == "table" {
+			printResults(os.Stdout, incidents, stats.Outcomes, time.Now(), settings.color)
+		}
+		if flags.GroupByDetector {
+			summary.ByDetector = countByDetector(stats.ResolvedIncidents)
+			if flags.Output == "text" || flags.Output == "table" {
+				printDetectorCounts(os.Stdout, "RESOLVED", summary.ByDetector, stats.Resolved)
+			}
+		}
+		logger.Infof("Incident ages: %s", formatAges(summary.Ages))
+		if err != nil {
+			taskErr = fmt.Errorf("error resolving incidents: %w", err)
+		}
+
+		if flags.SlackWebhook != "" && (len(stats.ResolvedIncidents) > 0 || flags.SlackAlways) {
+			if err := notifySlack(flags.SlackWebhook, slackResolveMessage(stats, flags.DryRun)); err != nil {
+				logger.Warnf("error notifying slack: %s", err)
+			}
+		}
+	case "mute":
+		filters, err := parseMuteFilters(flags)
+		if err != nil {
+			return err
+		}
+
+		now := time.Now()
+		if flags.ServerTime {
+			serverNow, err := client.ServerTime(ctx)
+			if err != nil {
+				logger.Warnf("error getting the API's time, using the local clock: %s", err)
+			} else {
+				if skew := serverNow.Sub(time.Now()); skew > maxClockSkew || skew < -maxClockSkew {
+					logger.Warnf("local clock is %s off the API's; using the API's time for the mute", skew.Round(time.Second))
+				}
+				now = serverNow
+			}
+		}
+		start, err := parseStart(flags.Start, now)
+		if err != nil {
+			return fmt.Errorf("error parsing start: %s", err)
+		}
+		if start.Before(now.Add(-startTolerance)) {
+			return fmt.Errorf("start is in the past: %s", flags.Start)
+		}
+
+		var stop time.Time
+		if flags.Stop != "" {
+			stop, err = time.Parse(time.RFC3339, flags.Stop)
+			if err != nil {
+				return fmt.Errorf("error parsing stop: %s", err)
+			}
+			if !stop.After(start) {
+				return fmt.Errorf("stop must be after start: %s", flags.Stop)
+			}
+		} else {
+			duration, err := time.ParseDuration(flags.Duration)
+			if err != nil {
+				return fmt.Errorf("error parsing duration: %s", err)
+			}
+			stop = start.Add(duration)
+		}
+
+		if err := janitor.CheckMuteDuration(stop.Sub(start), maxMuteDuration); err != nil {
+			return fmt.Errorf("invalid duration (pass allow-long-mute to override the maximum): %s", err)
+		}
+
+		detectorIDs := splitList(flags.Detector)
+		if flags.DetectorsFile != "" {
+			fromFile, err := readDetectorsFile(flags.DetectorsFile)
+			if err != nil {
+				return fmt.Errorf("error reading detectors-file: %s", err)
+			}
+			detectorIDs = append(detectorIDs, fromFile...)
+		}
+		if flags.DetectorName != "" {
+			id, err := janitor.DetectorIDByName(ctx, client, flags.DetectorName)
+			if err != nil {
+				return fmt.Errorf("error looking up detector-name: %w", err)
+			}
+			logger.Infof("Detector %q is %s", flags.DetectorName, id)
+			detectorIDs = append(detectorIDs, id)
+		}
+		if flags.DetectorNameHas != "" {
+			detectors, err := janitor.DetectorsNameContains(ctx, client, flags.DetectorNameHas)
+			if err != nil {
+				return fmt.Errorf("error looking up detector-name-contains: %w", err)
+			}
+			if len(detectors) == 0 {
+				return fmt.Errorf("no detector names contain %q", flags.DetectorNameHas)
+			}
+			if len(detectors) > maxDetectorsWithoutYes && !flags.Yes && !flags.DryRun {
+				return fmt.Errorf("%d detector names contain %q; pass yes to mute them all, or dry-run to list them", len(detectors), flags.DetectorNameHas)
+			}
+			for _, d := range detectors {
+				logger.Infof("Detector %q is %s", d.Name, d.ID)
+				detectorIDs = append(detectorIDs, d.ID)
+			}
+		}
+		if flags.Team != "" {
+			teamID, err := janitor.TeamID(ctx, client, flags.Team)
+			if err != nil {
+				return fmt.Errorf("error looking up team: %w", err)
+			}
+			detectors, err := janitor.TeamDetectors(ctx, client, teamID)
+			if err != nil {
+				return fmt.Errorf("error looking up team detectors: %w", err)
+			}
+			if len(detectors) == 0 {
+				return fmt.Errorf("team %s has no detectors", flags.Team)
+			}
+			if len(detectors) > maxDetectorsWithoutYes && !flags.Yes && !flags.DryRun {
+				return fmt.Errorf("team %s has %d detectors; pass yes to mute them all, or dry-run to list them", flags.Team, len(detectors))
+			}
+			for _, d := range detectors {
+				logger.Infof("Team %s detector %q is %s", flags.Team, d.Name, d.ID)
+				detectorIDs = append(detectorIDs, d.ID)
+			}
+		}
+
+		if flags.DryRun {
+			if len(detectorIDs) == 0 {
+				logger.Infof("dry-run: would mute %s from %s until %s", flags.Filter, start.Format(time.RFC3339), stop.Format(time.RFC3339))
+			} else {
+				logger.Infof("dry-run: would mute %d detectors from %s until %s: %s", len(detectorIDs),
+					start.Format(time.RFC3339), stop.Format(time.RFC3339), strings.Join(detectorIDs, ", "))
+			}
+			summary.DryRun = true
+			break
+		}
+
+		if len(detectorIDs) == 0 {
+			description := janitor.MutingDescription(flags.DescriptionTmpl, flags.Description, flags.Filter, start, stop)
+			err = client.CreateMuting(ctx, filters, start, stop, description)
+			if err != nil {
+				taskErr = fmt.Errorf("error muting %s: %w", flags.Filter, err)
+			} else {
+				logger.Infof("Muted %s from %s until %s", flags.Filter, start.Format(time.RFC3339), stop.Format(time.RFC3339))
+				summary.Muted = append(summary.Muted, flags.Filter)
+			}
+			break
+		}
+
+		muted, err := janitor.MuteDetectors(ctx, client, detectorIDs, janitor.MuteOptions{
+			Filters:             filters,
+			Start:               start,
+			Stop:                stop,
+			Description:         flags.Description,
+			DescriptionTemplate: flags.DescriptionTmpl,
+			Force:               flags.Force,
+			MaxDuration:         maxMuteDuration,
+		})
+		summary.Muted = muted
+		if err != nil {
+			taskErr = fmt.Errorf("error muting detectors: %w", err)
+			logger.Errorf("Failed to mute: %s", strings.Join(unmutedDetectors(detectorIDs, muted), ", "))
+		}
+	case "unmute":
+		mutings, err := client.ListAlertMutings(ctx, flags.Detector)
+		if err != nil {
+			taskErr = fmt.Errorf("error looking up mutings: %w", err)
+			break
+		}
+		if len(mutings) == 0 {
+			logger.Infof("No active mutings found for detector %s", flags.Detector)
+			break
+		}
+
+		for _, m := range mutings {
+			logger.Debugf("Unmuting: %s %s", m.ID, m.Description)
+			err = client.DeleteAlertMuting(ctx, m.ID)
+			if err != nil {
+				taskErr = fmt.Errorf("error unmuting detector: %w", err)
+				break
+			}
+		}
+		if taskErr == nil {
+			logger.Infof("Removed %d mutings for detector %s", len(mutings), flags.Detector)
+		}
+	case "clear":
+		ids := splitList(flags.IncidentID)
+		summary.DryRun = flags.DryRun
+		summary.Found = len(ids)
+
+		errs := janitor.MultiError{}
+		for _, id := range ids {
+			if ctx.Err() != nil {
+				errs = append(errs, ctx.Err())
+				break
+			}
+			if flags.DryRun {
+				logger.Infof("Would clear incident %s", id)
+				summary.Resolved++
+				continue
+			}
+			err := client.ClearIncident(ctx, id)
+			if errors.Is(err, janitor.ErrAlreadyCleared) {
+				logger.Infof("Incident %s was already cleared", id)
+				summary.AlreadyResolved++
+				continue
+			}
+			if err != nil {
+				logger.Errorf("error clearing incident %s: %s", id, err)
+				errs = append(errs, fmt.Errorf("error clearing incident %s: %w", id, err))
+				summary.Failed++
+				continue
+			}
+			logger.Infof("Cleared incident %s", id)
+			summary.Resolved++
+		}
+		if len(errs) > 0 {
+			taskErr = errs
+		}
+	case "list-detectors":
+		detectors, err := janitor.DetectorsNameContains(ctx, client, flags.NameContains)
+		if err != nil {
+			taskErr = fmt.Errorf("error looking up detectors: %w", err)
+			break
+		}
+		summary.Found = len(detectors)
+		if flags.Output == "jsonl" {
+			writeDetectorLines(os.Stdout, detectors)
+		} else if flags.Output != "json" {
+			printDetectors(os.Stdout, detectors)
+		}
+	case "list-mutings":
+		mutings, err := client.ListAlertMutings(ctx, flags.Detector)
+		if err != nil {
+			taskErr = fmt.Errorf("error looking up mutings: %w", err)
+			break
+		}
+		summary.Found = len(mutings)
+		if flags.Output == "jsonl" {
+			writeMutingLines(os.Stdout, mutings)
+		} else if flags.Output != "json" {
+			printMutings(os.Stdout, mutings)
+		}
+	default:
+		return fmt.Errorf("unexpected task: %s", flags.Task)
 	}
+	return taskErr
+}
 
-	return nil
+// cancelOnSignal returns a context that is cancelled on SIGINT or SIGTERM
+// (e.g. when Kubernetes stops the pod during a deploy), so in-flight work can
+// stop cleanly. A second signal exits immediately.
+func cancelOnSignal(logger janitor.Logger) context.Context {
+	ctx, cancel := context.WithCancel(context.Background())
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		sig := <-sigs
+		logger.Warnf("received %s, stopping", sig)
+		cancel()
+		<-sigs
+		os.Exit(exitFatal)
+	}()
+	return ctx
 }
 
-// muteDetector works for V1 and V2 detectors
-// https://developers.signalfx.com/reference#alertmuting-1
-func muteDetector(detectorID string, silence time.Duration, info string) error {
-	url := baseURL + "v2/alertmuting"
+// printUsageNotes follows the generated flag list in --help with defaults
+// that are too long to read from it
+func printUsageNotes(out io.Writer) {
+	fmt.Fprintln(out, "")
+	fmt.Fprintln(out, "The default -query (always ANDed with sf_organizationID:$SFX_ORG_ID) is:")
+	fmt.Fprintln(out, "  "+janitor.DefaultIncidentQuery)
+}
 
-	now := time.Now()
-	round := int64(time.Millisecond) / int64(time.Nanosecond)
-	args := map[string]interface{}{
-		"filters":     []map[string]string{{"property": "sf_detectorId", "propertyValue": detectorID}},
-		"startTime":   now.UnixNano() / round,
-		"stopTime":    now.Add(silence).UnixNano() / round,
-		"description": "Muted by signalfx-janitor",
+// maxDetectorsWithoutYes is how many detectors detector-name-contains or
+// team may match before muting them needs the yes flag
+const maxDetectorsWithoutYes = 10
+
+// Process exit codes, so callers can tell a partly failed run from a broken one
+const (
+	exitOK      = 0
+	exitFatal   = 1
+	exitPartial = 2
+	exitCapped  = 3
+)
+
+// exitCode picks exitPartial when some items failed but others succeeded,
+// and exitFatal for anything else that went wrong. A run that otherwise
+// succeeded but hit max-resolve gets exitCapped.
+func exitCode(taskErr error, summary *runSummary) int {
+	if taskErr == nil {
+		if summary.Capped > 0 {
+			return exitCapped
+		}
+		return exitOK
 	}
-	if info != "" {
-		args["description"] = fmt.Sprintf("%s: %s", args["description"], info)
+	var errs janitor.MultiError
+	succeeded := summary.Resolved + summary.AlreadyResolved + len(summary.Muted)
+	if errors.As(taskErr, &errs) && succeeded > 0 {
+		return exitPartial
+	}
+	return exitFatal
+}
+
+// runSummary is the machine-readable result of a run, printed with --output json
+type runSummary struct {
+	Task            string              `json:"task"`
+	DryRun          bool                `json:"dryRun,omitempty"`
+	Found           int                 `json:"found"`
+	New             int                 `json:"new,omitempty"`
+	Resolved        int                 `json:"resolved"`
+	Skipped         int                 `json:"skipped"`
+	AlreadyResolved int                 `json:"alreadyResolved"`
+	Failed          int                 `json:"failed"`
+	Stale           int                 `json:"stale,omitempty"`
+	Capped          int                 `json:"capped,omitempty"`
+	Ages            []janitor.AgeBucket `json:"ages,omitempty"`
+	Muted           []string            `json:"muted,omitempty"`
+	ByDetector      []detectorCount     `json:"byDetector,omitempty"`
+	Errors          []string            `json:"errors"`
+	// ErrorStatusCodes counts the errors that were API errors by status code
+	ErrorStatusCodes map[string]int `json:"errorStatusCodes,omitempty"`
+	DurationSeconds  float64        `json:"durationSeconds"`
+}
+
+// addError records one of the run's failures
+func (s *runSummary) addError(err error) {
+	s.Errors = append(s.Errors, err.Error())
+	var apiErr *janitor.APIError
+	if errors.As(err, &apiErr) {
+		if s.ErrorStatusCodes == nil {
+			s.ErrorStatusCodes = map[string]int{}
+		}
+		s.ErrorStatusCodes[strconv.Itoa(apiErr.StatusCode)]++
+	}
+}
+
+// formatAges renders an age distribution for logs, e.g. "<30m: 3, 30m-2h: 1"
+func formatAges(buckets []janitor.AgeBucket) string {
+	parts := []string{}
+	for _, b := range buckets {
+		parts = append(parts, fmt.Sprintf("%s: %d", b.Label, b.Count))
 	}
+	return strings.Join(parts, ", ")
+}
+
+// slackMaxListed caps how many incident labels are listed in a slack message
+const slackMaxListed = 20
 
-	data, _ := json.Marshal(args)
+// slackResolveMessage summarizes a stale run for slack
+func slackResolveMessage(stats janitor.ResolveStats, dryRun bool) string {
+	verb := "resolved"
+	if dryRun {
+		verb = "would have resolved (dry-run)"
+	}
+	lines := []string{fmt.Sprintf("signalfx-janitor %s %d of %d incidents", verb, stats.Resolved, stats.Found)}
+	for n, i := range stats.ResolvedIncidents {
+		if n == slackMaxListed {
+			lines = append(lines, fmt.Sprintf("• ...and %d more", len(stats.ResolvedIncidents)-n))
+			break
+		}
+		lines = append(lines, "• "+i.Label())
+	}
+	if stats.Failed > 0 {
+		lines = append(lines, fmt.Sprintf("%d incidents failed to resolve", stats.Failed))
+	}
+	return strings.Join(lines, "\n")
+}
 
-	req, err := http.NewRequest("POST", url, bytes.NewBuffer(data))
+// notifySlack posts text to a slack incoming webhook
+func notifySlack(webhookURL, text string) error {
+	data, _ := json.Marshal(map[string]string{"text": text})
+	client := &http.Client{Timeout: janitor.DefaultHTTPTimeout}
+	resp, err := client.Post(webhookURL, "application/json", bytes.NewBuffer(data))
 	if err != nil {
 		return err
 	}
-	req.Header.Set("X-SF-TOKEN", sfxToken)
-	req.Header.Set("Content-Type", "application/json")
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("slack webhook got StatusCode %d: %s", resp.StatusCode, body)
+	}
+	return nil
+}
+
+// maxWebhookErrors is how many error messages notifyErrorWebhook includes
+const maxWebhookErrors = 5
 
-	client := &http.Client{}
+// errorWebhookPayload is the JSON body notifyErrorWebhook posts
+type errorWebhookPayload struct {
+	Task       string   `json:"task"`
+	OrgID      string   `json:"orgId"`
+	ErrorCount int      `json:"errorCount"`
+	Errors     []string `json:"errors"`
+	Found      int      `json:"found"`
+	Resolved   int      `json:"resolved"`
+	Failed     int      `json:"failed"`
+}
 
-	resp, err := client.Do(req)
+// notifyErrorWebhook posts a run's error count and first few errors to a
+// generic webhook
+func notifyErrorWebhook(webhookURL, orgID string, summary *runSummary) error {
+	errs := summary.Errors
+	if len(errs) > maxWebhookErrors {
+		errs = errs[:maxWebhookErrors]
+	}
+	data, _ := json.Marshal(errorWebhookPayload{
+		Task:       summary.Task,
+		OrgID:      orgID,
+		ErrorCount: len(summary.Errors),
+		Errors:     errs,
+		Found:      summary.Found,
+		Resolved:   summary.Resolved,
+		Failed:     summary.Failed,
+	})
+	client := &http.Client{Timeout: janitor.DefaultHTTPTimeout}
+	resp, err := client.Post(webhookURL, "application/json", bytes.NewBuffer(data))
 	if err != nil {
 		return err
 	}
 	defer resp.Body.Close()
 
-	if resp.StatusCode != 201 {
-		body, err := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("error-webhook got StatusCode %d: %s", resp.StatusCode, body)
+	}
+	return nil
+}
+
+// isTerminal reports whether f is an interactive terminal rather than a pipe or file
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// confirm asks question on out and reports whether the answer read from in was yes
+func confirm(in io.Reader, out io.Writer, question string) bool {
+	fmt.Fprintf(out, "%s [y/N] ", question)
+	answer, _ := bufio.NewReader(in).ReadString('\n')
+	answer = strings.ToLower(strings.TrimSpace(answer))
+	return answer == "y" || answer == "yes"
+}
+
+// readDetectorsFile reads detector IDs one per line, ignoring blank lines and
+// # comments
+func readDetectorsFile(path string) ([]string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	ids := []string{}
+	for _, line := range strings.Split(string(data), "\n") {
+		if n := strings.Index(line, "#"); n >= 0 {
+			line = line[:n]
+		}
+		if line = strings.TrimSpace(line); line != "" {
+			ids = append(ids, line)
+		}
+	}
+	return ids, nil
+}
+
+// unmutedDetectors returns the detectorIDs not in muted
+func unmutedDetectors(detectorIDs, muted []string) []string {
+	done := map[string]bool{}
+	for _, id := range muted {
+		done[id] = true
+	}
+	failed := []string{}
+	for _, id := range detectorIDs {
+		if !done[id] {
+			failed = append(failed, id)
+		}
+	}
+	return failed
+}
+
+// splitList splits a comma-separated flag value, dropping empty entries
+func splitList(s string) []string {
+	items := []string{}
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// userAgent is the flag value, or janitor.DefaultUserAgent() with the flag
+// value appended if it starts with "+"
+func userAgent(flag string) string {
+	if flag == "" {
+		return janitor.DefaultUserAgent()
+	}
+	if strings.HasPrefix(flag, "+") {
+		return janitor.DefaultUserAgent() + " " + strings.TrimSpace(flag[1:])
+	}
+	return flag
+}
+
+// firstOrEmpty is items[0], or "" if items is empty
+func firstOrEmpty(items []string) string {
+	if len(items) == 0 {
+		return ""
+	}
+	return items[0]
+}
+
+// restOrNil is items after the first, or nil if there are none
+func restOrNil(items []string) []string {
+	if len(items) < 2 {
+		return nil
+	}
+	return items[1:]
+}
+
+// contains reports whether items includes s
+func contains(items []string, s string) bool {
+	for _, item := range items {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// parseFilters parses comma-separated property=value pairs into muting filters
+func parseFilters(s string) ([]janitor.AlertMutingFilter, error) {
+	filters := []janitor.AlertMutingFilter{}
+	for _, pair := range splitList(s) {
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) != 2 || kv[0] == "" || kv[1] == "" {
+			return []janitor.AlertMutingFilter{}, fmt.Errorf("expected property=value, got %q", pair)
+		}
+		filters = append(filters, janitor.AlertMutingFilter{Property: kv[0], PropertyValue: kv[1]})
+	}
+	return filters, nil
+}
+
+// maxClockSkew is how far the local clock may be off the API's before
+// server-time warns about it
+const maxClockSkew = 5 * time.Second
+
+// startTolerance is how far in the past a mute's start may be, to allow for
+// the time between parsing flags and making the request
+const startTolerance = time.Minute
+
+// parseStart parses a mute start time, either RFC3339 or an offset from now
+// like "+2h". An empty value means now.
+func parseStart(value string, now time.Time) (time.Time, error) {
+	if value == "" {
+		return now, nil
+	}
+	if strings.HasPrefix(value, "+") {
+		offset, err := time.ParseDuration(value[1:])
 		if err != nil {
-			return err
+			return time.Time{}, err
 		}
-		log.Println("error:", string(body))
-		return fmt.Errorf("Error muting detector %s, got StatusCode %d", detectorID, resp.StatusCode)
+		return now.Add(offset), nil
 	}
+	return time.Parse(time.RFC3339, value)
+}
 
-	return nil
+// printReport writes incidents as a table, oldest first, followed by how
+// many each detector contributed, totalled under title
+func printReport(out io.Writer, incidents []janitor.SimpleIncident, now time.Time, title string) {
+	sorted := sortByAge(incidents)
+
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "AGE\tSEVERITY\tID\tDETECTOR")
+	for _, i := range sorted {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", now.Sub(i.UpdatedAt).Round(time.Second), i.Severity, i.ID, i.Label())
+	}
+	w.Flush()
+
+	fmt.Fprintln(out, "")
+	printDetectorCounts(out, title, countByDetector(sorted), len(sorted))
+}
+
+// detectorCount is how many incidents a detector had, for per-detector totals
+type detectorCount struct {
+	Detector string `json:"detector"`
+	Count    int    `json:"count"`
+}
+
+// countByDetector totals incidents by detector label, most first. Detectors
+// with the same count keep the order they first appear in.
+func countByDetector(incidents []janitor.SimpleIncident) []detectorCount {
+	counts := []detectorCount{}
+	index := map[string]int{}
+	for _, i := range incidents {
+		n, ok := index[i.Label()]
+		if !ok {
+			n = len(counts)
+			index[i.Label()] = n
+			counts = append(counts, detectorCount{Detector: i.Label()})
+		}
+		counts[n].Count++
+	}
+	sort.SliceStable(counts, func(a, b int) bool { return counts[a].Count > counts[b].Count })
+	return counts
+}
+
+// printDetectorCounts prints per-detector totals under header, then total
+func printDetectorCounts(out io.Writer, header string, counts []detectorCount, total int) {
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(w, "%s\tDETECTOR\n", header)
+	for _, c := range counts {
+		fmt.Fprintf(w, "%d\t%s\n", c.Count, c.Detector)
+	}
+	fmt.Fprintf(w, "%d\t%s\n", total, "total")
+	w.Flush()
+}
+
+// printDetectorSummary writes how many incidents each detector has, most
+// first, and how old its oldest one is, without the incidents themselves
+func printDetectorSummary(out io.Writer, incidents []janitor.SimpleIncident, now time.Time, title string) {
+	sorted := sortByAge(incidents)
+	oldest := map[string]time.Time{}
+	for _, i := range sorted {
+		if _, ok := oldest[i.Label()]; !ok {
+			oldest[i.Label()] = i.UpdatedAt
+		}
+	}
+
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(w, "DETECTOR\t%s\tOLDEST\n", title)
+	for _, c := range countByDetector(sorted) {
+		fmt.Fprintf(w, "%s\t%d\t%s\n", c.Detector, c.Count, now.Sub(oldest[c.Detector]).Round(time.Second))
+	}
+	fmt.Fprintf(w, "%s\t%d\t\n", "total", len(sorted))
+	w.Flush()
+}
+
+// sortByAge returns a copy of incidents, oldest first
+func sortByAge(incidents []janitor.SimpleIncident) []janitor.SimpleIncident {
+	sorted := append([]janitor.SimpleIncident{}, incidents...)
+	sort.SliceStable(sorted, func(a, b int) bool { return sorted[a].UpdatedAt.Before(sorted[b].UpdatedAt) })
+	return sorted
+}
+
+// incidentLine is an incident as written by --output jsonl
+type incidentLine struct {
+	ID           string    `json:"id"`
+	DetectorID   string    `json:"detectorId"`
+	DetectorName string    `json:"detectorName"`
+	Severity     string    `json:"severity"`
+	UpdatedAt    time.Time `json:"updatedAt"`
+	Muted        bool      `json:"muted"`
+	New          bool      `json:"new"`
+	AgeSeconds   float64   `json:"ageSeconds"`
+}
+
+// writeIncidentLines writes incidents as JSON lines, oldest first
+func writeIncidentLines(out io.Writer, incidents []janitor.SimpleIncident, now time.Time) {
+	enc := json.NewEncoder(out)
+	for _, i := range sortByAge(incidents) {
+		enc.Encode(incidentLine{
+			ID:           i.ID,
+			DetectorID:   i.DetectorID,
+			DetectorName: i.DetectorName,
+			Severity:     i.Severity.String(),
+			UpdatedAt:    i.UpdatedAt,
+			Muted:        i.Muted,
+			New:          i.New,
+			AgeSeconds:   now.Sub(i.UpdatedAt).Seconds(),
+		})
+	}
+}
+
+// mutingLine is a muting as written by --output jsonl
+type mutingLine struct {
+	janitor.AlertMuting
+	Start time.Time `json:"start"`
+	Stop  time.Time `json:"stop"`
+}
+
+// writeMutingLines writes mutings as JSON lines
+func writeMutingLines(out io.Writer, mutings []janitor.AlertMuting) {
+	enc := json.NewEncoder(out)
+	for _, m := range mutings {
+		enc.Encode(mutingLine{AlertMuting: m, Start: m.Start(), Stop: m.Stop()})
+	}
+}
+
+// printDetectors prints detectors in a table, sorted by name
+func printDetectors(out io.Writer, detectors []janitor.Detector) {
+	sorted := append([]janitor.Detector{}, detectors...)
+	sort.SliceStable(sorted, func(a, b int) bool { return strings.ToLower(sorted[a].Name) < strings.ToLower(sorted[b].Name) })
+
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "NAME\tID")
+	for _, d := range sorted {
+		fmt.Fprintf(w, "%s\t%s\n", d.Name, d.ID)
+	}
+	w.Flush()
+}
+
+// writeDetectorLines writes detectors as JSON lines
+func writeDetectorLines(out io.Writer, detectors []janitor.Detector) {
+	enc := json.NewEncoder(out)
+	for _, d := range detectors {
+		enc.Encode(d)
+	}
+}
+
+// printMutings writes mutings as an aligned table
+func printMutings(out io.Writer, mutings []janitor.AlertMuting) {
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tFILTERS\tDESCRIPTION\tSTART\tSTOP")
+	for _, m := range mutings {
+		filters := []string{}
+		for _, f := range m.Filters {
+			op := "="
+			if f.NOT {
+				op = "!="
+			}
+			filters = append(filters, f.Property+op+f.PropertyValue)
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", m.ID, strings.Join(filters, ","), m.Description,
+			m.Start().Format(time.RFC3339), m.Stop().Format(time.RFC3339))
+	}
+	w.Flush()
 }
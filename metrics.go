@@ -0,0 +1,126 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/Clever/signalfx-janitor/janitor"
+)
+
+// runDurationBuckets are the upper bounds, in seconds, of the run duration histogram
+var runDurationBuckets = []float64{1, 5, 10, 30, 60, 120, 300, 600, 1800}
+
+// metrics are the janitor's Prometheus metrics, written in the text
+// exposition format by ServeHTTP
+type metrics struct {
+	mu sync.Mutex
+
+	incidentsResolved float64
+	incidentsFound    float64
+	apiErrors         map[string]float64 // by status code
+
+	runDurationCounts []uint64 // per bucket, not cumulative
+	runDurationSum    float64
+	runDurationCount  uint64
+}
+
+func newMetrics() *metrics {
+	return &metrics{
+		apiErrors:         map[string]float64{},
+		runDurationCounts: make([]uint64, len(runDurationBuckets)),
+	}
+}
+
+// observeRun records the outcome of one run
+func (m *metrics) observeRun(summary *runSummary, duration time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.incidentsFound = float64(summary.Found)
+	if !summary.DryRun {
+		m.incidentsResolved += float64(summary.Resolved)
+	}
+
+	seconds := duration.Seconds()
+	for n, bound := range runDurationBuckets {
+		if seconds <= bound {
+			m.runDurationCounts[n]++
+			break
+		}
+	}
+	m.runDurationSum += seconds
+	m.runDurationCount++
+}
+
+// observeAPIError counts a failed API request. A statusCode of 0 means the
+// request never got a response.
+func (m *metrics) observeAPIError(statusCode int) {
+	code := "none"
+	if statusCode != 0 {
+		code = strconv.Itoa(statusCode)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.apiErrors[code]++
+}
+
+func (m *metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	m.write(w)
+}
+
+func (m *metrics) write(w io.Writer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	fmt.Fprintln(w, "# HELP signalfx_janitor_incidents_resolved_total Incidents resolved by the janitor.")
+	fmt.Fprintln(w, "# TYPE signalfx_janitor_incidents_resolved_total counter")
+	fmt.Fprintf(w, "signalfx_janitor_incidents_resolved_total %s\n", formatFloat(m.incidentsResolved))
+
+	fmt.Fprintln(w, "# HELP signalfx_janitor_incidents_found Active incidents found by the last run.")
+	fmt.Fprintln(w, "# TYPE signalfx_janitor_incidents_found gauge")
+	fmt.Fprintf(w, "signalfx_janitor_incidents_found %s\n", formatFloat(m.incidentsFound))
+
+	fmt.Fprintln(w, "# HELP signalfx_janitor_api_errors_total Failed SignalFX API requests, by status code.")
+	fmt.Fprintln(w, "# TYPE signalfx_janitor_api_errors_total counter")
+	codes := []string{}
+	for code := range m.apiErrors {
+		codes = append(codes, code)
+	}
+	sort.Strings(codes)
+	for _, code := range codes {
+		fmt.Fprintf(w, "signalfx_janitor_api_errors_total{code=%q} %s\n", code, formatFloat(m.apiErrors[code]))
+	}
+
+	fmt.Fprintln(w, "# HELP signalfx_janitor_run_duration_seconds How long janitor runs take.")
+	fmt.Fprintln(w, "# TYPE signalfx_janitor_run_duration_seconds histogram")
+	var cumulative uint64
+	for n, bound := range runDurationBuckets {
+		cumulative += m.runDurationCounts[n]
+		fmt.Fprintf(w, "signalfx_janitor_run_duration_seconds_bucket{le=%q} %d\n", formatFloat(bound), cumulative)
+	}
+	fmt.Fprintf(w, "signalfx_janitor_run_duration_seconds_bucket{le=\"+Inf\"} %d\n", m.runDurationCount)
+	fmt.Fprintf(w, "signalfx_janitor_run_duration_seconds_sum %s\n", formatFloat(m.runDurationSum))
+	fmt.Fprintf(w, "signalfx_janitor_run_duration_seconds_count %d\n", m.runDurationCount)
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+// serveMetrics exposes m on addr at /metrics, in the background
+func serveMetrics(addr string, m *metrics, logger janitor.Logger) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", m)
+	go func() {
+		if err := http.ListenAndServe(addr, mux); err != nil {
+			logger.Errorf("metrics server stopped: %s", err)
+		}
+	}()
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/Clever/signalfx-janitor/janitor"
+)
+
+// runState is what --state-file remembers between runs
+type runState struct {
+	UpdatedAt   time.Time `json:"updatedAt"`
+	IncidentIDs []string  `json:"incidentIds"`
+}
+
+// loadSeenIncidents reads the incident IDs the last run saw from path. A
+// missing file means there was no last run; a corrupt one is returned as an
+// error alongside an empty set, so callers can warn and carry on.
+func loadSeenIncidents(path string) (map[string]bool, error) {
+	seen := map[string]bool{}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return seen, nil
+	} else if err != nil {
+		return seen, err
+	}
+	state := runState{}
+	if err := json.Unmarshal(data, &state); err != nil {
+		return seen, err
+	}
+	for _, id := range state.IncidentIDs {
+		seen[id] = true
+	}
+	return seen, nil
+}
+
+// saveSeenIncidents replaces path with the IDs of incidents. It writes a
+// temporary file and renames it, so a crash can't leave a truncated file.
+func saveSeenIncidents(path string, incidents []janitor.SimpleIncident, now time.Time) error {
+	state := runState{UpdatedAt: now, IncidentIDs: []string{}}
+	for _, i := range incidents {
+		state.IncidentIDs = append(state.IncidentIDs, i.ID)
+	}
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"text/template"
+	"time"
+
+	"github.com/Clever/signalfx-janitor/janitor"
+)
+
+// ANSI escapes for --color
+const (
+	colorReset  = "\x1b[0m"
+	colorRed    = "\x1b[31m"
+	colorGreen  = "\x1b[32m"
+	colorYellow = "\x1b[33m"
+)
+
+// useColor decides --color: always, never, or auto, which colors only when
+// out is a terminal and NO_COLOR isn't set (see https://no-color.org)
+func useColor(mode string, out *os.File) (bool, error) {
+	switch mode {
+	case "always":
+		return true, nil
+	case "never":
+		return false, nil
+	case "auto":
+		_, noColor := os.LookupEnv("NO_COLOR")
+		return !noColor && isTerminal(out), nil
+	default:
+		return false, fmt.Errorf("must be one of auto, always, never: %s", mode)
+	}
+}
+
+// outcomeColors are the colors of each outcome in printResults
+var outcomeColors = map[janitor.Outcome]string{
+	janitor.OutcomeResolved:        colorGreen,
+	janitor.OutcomeAlreadyResolved: colorGreen,
+	janitor.OutcomeSkipped:         colorYellow,
+	janitor.OutcomeCapped:          colorYellow,
+	janitor.OutcomeFailed:          colorRed,
+}
+
+// printResults prints incidents oldest first, in aligned columns with what
+// happened to each. Incidents without an outcome weren't processed, e.g.
+// because the run was cancelled.
+func printResults(out io.Writer, incidents []janitor.SimpleIncident, outcomes map[string]janitor.Outcome, now time.Time, color bool) {
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "STATUS\tAGE\tSEVERITY\tDETECTOR\tID")
+	for _, i := range sortByAge(incidents) {
+		status := string(outcomes[i.ID])
+		if status == "" {
+			status = "-"
+		}
+		// pad before coloring, since tabwriter counts the escapes as text
+		status = fmt.Sprintf("%-16s", status)
+		if c, ok := outcomeColors[outcomes[i.ID]]; ok && color {
+			status = c + status + colorReset
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", status, now.Sub(i.UpdatedAt).Round(time.Second), i.Severity, i.Label(), i.ID)
+	}
+	w.Flush()
+}
+
+// formattedIncident is what a --format template is executed with: the
+// incident's fields, plus its Age
+type formattedIncident struct {
+	janitor.SimpleIncident
+	Age time.Duration
+}
+
+// parseFormat parses a --format template. Each incident's output gets a
+// trailing newline unless the template ends with one.
+func parseFormat(format string) (*template.Template, error) {
+	if !strings.HasSuffix(format, "\n") {
+		format += "\n"
+	}
+	return template.New("format").Parse(format)
+}
+
+// writeFormatted executes tmpl for each incident, oldest first
+func writeFormatted(out io.Writer, tmpl *template.Template, incidents []janitor.SimpleIncident, now time.Time) error {
+	for _, i := range sortByAge(incidents) {
+		if err := tmpl.Execute(out, formattedIncident{SimpleIncident: i, Age: now.Sub(i.UpdatedAt).Round(time.Second)}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Clever/signalfx-janitor/janitor"
+)
+
+// traceExportTimeout bounds sending a run's spans, which happens even if
+// the run was cancelled
+const traceExportTimeout = 10 * time.Second
+
+// tracer collects spans in memory and exports them to an OpenTelemetry
+// collector with OTLP over HTTP, in its JSON encoding, after each run
+type tracer struct {
+	endpoint    string
+	headers     map[string]string
+	serviceName string
+	httpClient  *http.Client
+
+	mu    sync.Mutex
+	spans []*span
+}
+
+// newTracerFromEnv configures a tracer from the standard OTEL_* env vars,
+// or returns nil if OTEL_EXPORTER_OTLP_ENDPOINT (or its traces-only
+// variant) isn't set
+func newTracerFromEnv() *tracer {
+	endpoint := os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT")
+	if endpoint == "" {
+		base := os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT")
+		if base == "" {
+			return nil
+		}
+		endpoint = strings.TrimSuffix(base, "/") + "/v1/traces"
+	}
+	serviceName := os.Getenv("OTEL_SERVICE_NAME")
+	if serviceName == "" {
+		serviceName = "signalfx-janitor"
+	}
+	headers := map[string]string{}
+	for _, pair := range splitList(os.Getenv("OTEL_EXPORTER_OTLP_HEADERS")) {
+		if eq := strings.Index(pair, "="); eq > 0 {
+			headers[strings.TrimSpace(pair[:eq])] = strings.TrimSpace(pair[eq+1:])
+		}
+	}
+	return &tracer{
+		endpoint:    endpoint,
+		headers:     headers,
+		serviceName: serviceName,
+		httpClient:  &http.Client{Timeout: traceExportTimeout},
+	}
+}
+
+type spanContextKey struct{}
+
+// Start begins a span, as a child of the span in ctx if there is one
+func (t *tracer) Start(ctx context.Context, name string) (context.Context, janitor.Span) {
+	s := &span{tracer: t, name: name, start: time.Now(), attributes: map[string]interface{}{}}
+	if parent, ok := ctx.Value(spanContextKey{}).(*span); ok {
+		s.traceID = parent.traceID
+		s.parentID = parent.spanID
+	} else {
+		rand.Read(s.traceID[:])
+	}
+	rand.Read(s.spanID[:])
+	return context.WithValue(ctx, spanContextKey{}, s), s
+}
+
+// span is one span of a tracer
+type span struct {
+	tracer   *tracer
+	traceID  [16]byte
+	spanID   [8]byte
+	parentID [8]byte // zero for root spans
+	name     string
+	start    time.Time
+
+	mu         sync.Mutex
+	attributes map[string]interface{}
+	end        time.Time
+	err        error
+}
+
+func (s *span) SetAttribute(key string, value interface{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.attributes[key] = value
+}
+
+func (s *span) End(err error) {
+	s.mu.Lock()
+	s.end, s.err = time.Now(), err
+	s.mu.Unlock()
+
+	s.tracer.mu.Lock()
+	defer s.tracer.mu.Unlock()
+	s.tracer.spans = append(s.tracer.spans, s)
+}
+
+// flush exports the spans ended since the last flush. Failures are only
+// logged, since tracing shouldn't fail a run.
+func (t *tracer) flush(logger janitor.Logger) {
+	t.mu.Lock()
+	spans := t.spans
+	t.spans = nil
+	t.mu.Unlock()
+	if len(spans) == 0 {
+		return
+	}
+
+	if err := t.export(spans); err != nil {
+		logger.Warnf("error exporting %d spans to %s: %s", len(spans), t.endpoint, err)
+	}
+}
+
+func (t *tracer) export(spans []*span) error {
+	body, err := json.Marshal(t.request(spans))
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), traceExportTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "POST", t.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for name, value := range t.headers {
+		req.Header.Set(name, value)
+	}
+	resp, err := t.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("StatusCode %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// otlpAttribute is an OTLP KeyValue
+type otlpAttribute struct {
+	Key   string                 `json:"key"`
+	Value map[string]interface{} `json:"value"`
+}
+
+type otlpSpan struct {
+	TraceID           string          `json:"traceId"`
+	SpanID            string          `json:"spanId"`
+	ParentSpanID      string          `json:"parentSpanId,omitempty"`
+	Name              string          `json:"name"`
+	Kind              int             `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []otlpAttribute `json:"attributes,omitempty"`
+	Status            *otlpStatus     `json:"status,omitempty"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+const (
+	otlpSpanKindInternal = 1
+	otlpSpanKindClient   = 3
+	otlpStatusError      = 2
+)
+
+// request is the ExportTraceServiceRequest for spans.
+// https://opentelemetry.io/docs/specs/otlp/#json-protobuf-encoding
+func (t *tracer) request(spans []*span) interface{} {
+	out := []otlpSpan{}
+	for _, s := range spans {
+		s.mu.Lock()
+		o := otlpSpan{
+			TraceID:           hex.EncodeToString(s.traceID[:]),
+			SpanID:            hex.EncodeToString(s.spanID[:]),
+			Name:              s.name,
+			Kind:              otlpSpanKindInternal,
+			StartTimeUnixNano: strconv.FormatInt(s.start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(s.end.UnixNano(), 10),
+		}
+		if s.parentID != [8]byte{} {
+			o.ParentSpanID = hex.EncodeToString(s.parentID[:])
+			o.Kind = otlpSpanKindClient
+		}
+		for key, value := range s.attributes {
+			o.Attributes = append(o.Attributes, otlpAttribute{Key: key, Value: otlpValue(value)})
+		}
+		if s.err != nil {
+			o.Status = &otlpStatus{Code: otlpStatusError, Message: s.err.Error()}
+		}
+		s.mu.Unlock()
+		out = append(out, o)
+	}
+
+	return map[string]interface{}{
+		"resourceSpans": []interface{}{map[string]interface{}{
+			"resource": map[string]interface{}{
+				"attributes": []otlpAttribute{{Key: "service.name", Value: otlpValue(t.serviceName)}},
+			},
+			"scopeSpans": []interface{}{map[string]interface{}{
+				"scope": map[string]string{"name": "github.com/Clever/signalfx-janitor"},
+				"spans": out,
+			}},
+		}},
+	}
+}
+
+// otlpValue is an OTLP AnyValue. Ints are strings, as the JSON encoding
+// requires for 64-bit integers.
+func otlpValue(value interface{}) map[string]interface{} {
+	switch v := value.(type) {
+	case bool:
+		return map[string]interface{}{"boolValue": v}
+	case int:
+		return map[string]interface{}{"intValue": strconv.Itoa(v)}
+	case int64:
+		return map[string]interface{}{"intValue": strconv.FormatInt(v, 10)}
+	default:
+		return map[string]interface{}{"stringValue": fmt.Sprint(v)}
+	}
+}